@@ -4,13 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hellish/Database"
-	"hellish/crypto"
+	"hellish/Metrics"
+	"hellish/Tracing"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // --- Structs for Gemini API Request & Response ---
@@ -18,6 +24,27 @@ import (
 type RequestBody struct {
 	SystemInstruction SystemInstruction `json:"system_instruction"`
 	Contents          []Content         `json:"contents"`
+	GenerationConfig  *GenerationConfig `json:"generationConfig,omitempty"`
+	SafetySettings    []SafetySetting   `json:"safetySettings,omitempty"`
+}
+
+// SafetySetting sets how readily Gemini blocks content of one harm category.
+type SafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+// unfiltered turns off Gemini's blocking for every adjustable category, for
+// requests that must read harmful text rather than answer it.
+var unfiltered = []SafetySetting{
+	{"HARM_CATEGORY_HARASSMENT", "BLOCK_NONE"},
+	{"HARM_CATEGORY_HATE_SPEECH", "BLOCK_NONE"},
+	{"HARM_CATEGORY_SEXUALLY_EXPLICIT", "BLOCK_NONE"},
+	{"HARM_CATEGORY_DANGEROUS_CONTENT", "BLOCK_NONE"},
+}
+
+type GenerationConfig struct {
+	ResponseMimeType string `json:"responseMimeType,omitempty"`
 }
 
 type SystemInstruction struct {
@@ -32,17 +59,43 @@ type Part struct {
 	Text string `json:"text"`
 }
 
+type SafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked"`
+}
+
 type ApiResponse struct {
 	Candidates []struct {
 		Content struct {
 			Parts []Part `json:"parts"`
 		} `json:"content"`
+		FinishReason  string         `json:"finishReason"`
+		SafetyRatings []SafetyRating `json:"safetyRatings"`
 	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason   string         `json:"blockReason"`
+		SafetyRatings []SafetyRating `json:"safetyRatings"`
+	} `json:"promptFeedback"`
 	Error *struct {
 		Code    int    `json:"code"`
 		Message string `json:"message"`
 		Status  string `json:"status"`
 	} `json:"error"`
+	UsageMetadata *struct {
+		PromptTokenCount     int64 `json:"promptTokenCount"`
+		CandidatesTokenCount int64 `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// apiErrorMessage pulls the error message out of a failed response body, so the
+// body itself, which may echo the request, isn't logged.
+func apiErrorMessage(body []byte) string {
+	var response ApiResponse
+	if err := json.Unmarshal(body, &response); err != nil || response.Error == nil {
+		return "unreadable error response"
+	}
+	return response.Error.Message
 }
 
 // Base persona for the Hellish Queen.
@@ -54,102 +107,313 @@ Instructions:
 Answer only as {shape}. You cannot perform real-life actions; you can only send chat messages on Discord. Always consider the system_message context to adapt your replies to the user's server, topic, and community events. Be playful, teasing, and confident. Reply in a way that fits casual Discord conversation style.
 `
 
+// Reply is a generated answer together with the safety metadata Gemini attached to it.
+type Reply struct {
+	Text          string
+	FinishReason  string
+	SafetyRatings []SafetyRating
+	PromptTokens  int64
+	OutputTokens  int64
+}
+
+// ErrNoAPIKeys is returned when a server has no API keys to generate with.
+var ErrNoAPIKeys = errors.New("no API keys are configured for this server")
+
+// BlockedError is returned when Gemini refuses to produce a reply, either because
+// the prompt was blocked or because generation stopped for safety or recitation.
+type BlockedError struct {
+	Reason        string
+	SafetyRatings []SafetyRating
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("response blocked by the model (%s)", e.Reason)
+}
+
+// blockingFinishReasons are the finish reasons that mean the candidate was withheld.
+var blockingFinishReasons = map[string]bool{
+	"SAFETY":             true,
+	"RECITATION":         true,
+	"BLOCKLIST":          true,
+	"PROHIBITED_CONTENT": true,
+	"SPII":               true,
+}
+
+// Client generates replies with the API keys a server has stored.
+type Client struct {
+	db   *Database.DB
+	http *http.Client
+}
+
+// requestTimeout bounds a single Gemini call, so one slow key doesn't use up
+// the caller's whole deadline before the next key is tried.
+const requestTimeout = 45 * time.Second
+
+const generateURL = "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.5-flash:generateContent"
+
+// New returns a Client that looks up API keys in db. All requests share one
+// HTTP client, so connections to Gemini are reused.
+func New(db *Database.DB) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 20
+	transport.IdleConnTimeout = 90 * time.Second
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ResponseHeaderTimeout = requestTimeout
+
+	return &Client{
+		db:   db,
+		http: &http.Client{Transport: transport, Timeout: requestTimeout},
+	}
+}
+
 // Response fetches API keys from the database and attempts to generate a response.
 // If an API key fails, it automatically tries the next one in the list.
-func Response(guildID, systemInstruction, userInput string) (string, error) {
-	// 1. Fetch all available API keys for the server from the database.
-	apiKeys, err := Database.ViewAPIKeys(guildID)
+// It gives up when ctx is done.
+func (c *Client) Response(ctx context.Context, guildID, systemInstruction, userInput string) (string, error) {
+	reply, err := c.Generate(ctx, guildID, systemInstruction, userInput)
 	if err != nil {
-		return "", fmt.Errorf("could not fetch API keys from database: %w", err)
+		return "", err
 	}
+	return reply.Text, nil
+}
 
-	if len(apiKeys) == 0 {
-		return "", fmt.Errorf("no API keys are configured for this server. Please use `!api add` to add one")
+// Generate works like Response but returns the reply along with its finish reason
+// and safety ratings so callers can moderate it before posting.
+func (c *Client) Generate(ctx context.Context, guildID, systemInstruction, userInput string) (*Reply, error) {
+	// Construct the request body
+	requestBody := RequestBody{
+		SystemInstruction: SystemInstruction{
+			Parts: []Part{{Text: systemInstruction}},
+		},
+		Contents: []Content{
+			{Parts: []Part{{Text: userInput}}},
+		},
 	}
+	return c.generate(ctx, guildID, requestBody)
+}
 
-	// 2. Loop through each key and try to get a response.
-	var lastError error
-	for _, apiKey := range apiKeys {
-		apiKey, err := crypto.Decrypt(apiKey)
-		if err != nil {
-			return "", err
-		}
-		// Construct the request body
-		requestBody := RequestBody{
-			SystemInstruction: SystemInstruction{
-				Parts: []Part{{Text: systemInstruction}},
-			},
-			Contents: []Content{
-				{Parts: []Part{{Text: userInput}}},
-			},
-		}
-
-		jsonData, err := json.Marshal(requestBody)
-		if err != nil {
-			log.Printf("Error marshaling JSON: %v. This is an internal error, not an API key issue.", err)
-			continue // Should not happen, but good to be safe
-		}
+func (c *Client) generate(ctx context.Context, guildID string, requestBody RequestBody) (reply *Reply, err error) {
+	start := time.Now()
+	ctx, span := Tracing.Start(ctx, "gemini.generate", attribute.String("discord.guild_id", guildID))
+	defer func() {
+		Metrics.AIDuration.Observe(time.Since(start).Seconds(), result(ctx, err))
+		span.SetAttributes(attribute.String("gemini.result", result(ctx, err)))
+		Tracing.End(span, err)
+	}()
 
-		// Create and send the HTTP request
-		url := "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.5-flash:generateContent"
-		req, err := http.NewRequestWithContext(context.Background(), "POST", url, bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Printf("Error creating request: %v", err)
-			continue
-		}
+	// 1. Fetch and decrypt all available API keys for the server from the database.
+	apiKeys, err := c.db.APIKeys(ctx, guildID)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch API keys from database: %w", err)
+	}
 
-		req.Header.Set("x-goog-api-key", apiKey)
-		req.Header.Set("Content-Type", "application/json")
+	if len(apiKeys) == 0 {
+		return nil, ErrNoAPIKeys
+	}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			lastError = fmt.Errorf("request failed for a key: %w", err)
-			log.Printf("Network error with an API key: %v. Trying next key.", err)
-			continue
-		}
-		defer resp.Body.Close()
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			lastError = fmt.Errorf("failed to read response body for a key: %w", err)
-			log.Printf("Error reading response body: %v. Trying next key.", err)
-			continue
+	// 2. Loop through each key and try to get a response.
+	var lastError error
+	for i, apiKey := range apiKeys {
+		// Cancellation (shutdown, or the user deleting their message) applies to
+		// every key, so stop instead of trying the next one.
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
-
-		// Check for non-200 HTTP status codes first
-		if resp.StatusCode != http.StatusOK {
-			lastError = fmt.Errorf("API returned status %d", resp.StatusCode)
-			log.Printf("API key failed with status %d. Response: %s. Trying next key.", resp.StatusCode, string(body))
-			continue
+		if i > 0 {
+			Metrics.AIRetries.Inc()
 		}
 
-		// Parse the JSON response
-		var apiResponse ApiResponse
-		if err := json.Unmarshal(body, &apiResponse); err != nil {
-			lastError = fmt.Errorf("failed to parse API response: %w", err)
-			log.Printf("Error parsing JSON response: %v. Raw: %s. Trying next key.", err, string(body))
+		apiResponse, err := c.attempt(ctx, i+1, apiKey, jsonData)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastError = err
+			Metrics.AIKeyFailures.Inc(failureStatus(err))
+			slog.Warn("API key failed, trying next key", "guild", guildID, "key_index", i+1, "err", err)
 			continue
 		}
 
 		// Check for an error object within the JSON response itself
 		if apiResponse.Error != nil {
 			lastError = fmt.Errorf("API error: %s", apiResponse.Error.Message)
-			log.Printf("API returned an error for a key: %s. Trying next key.", apiResponse.Error.Message)
+			Metrics.AIKeyFailures.Inc("api_error")
+			slog.Warn("API returned an error for a key, trying next key", "guild", guildID, "key_index", i+1, "error", apiResponse.Error.Message)
 			continue
 		}
 
-		// 3. If we get a valid response, return it immediately.
-		if len(apiResponse.Candidates) > 0 && len(apiResponse.Candidates[0].Content.Parts) > 0 {
-			return apiResponse.Candidates[0].Content.Parts[0].Text, nil
+		// A blocked prompt or a withheld candidate is not a key problem, so another key won't help.
+		if fb := apiResponse.PromptFeedback; fb != nil && fb.BlockReason != "" {
+			return nil, &BlockedError{Reason: fb.BlockReason, SafetyRatings: fb.SafetyRatings}
+		}
+		if len(apiResponse.Candidates) > 0 {
+			candidate := apiResponse.Candidates[0]
+			if blockingFinishReasons[candidate.FinishReason] {
+				return nil, &BlockedError{Reason: candidate.FinishReason, SafetyRatings: candidate.SafetyRatings}
+			}
+
+			// 3. If we get a valid response, return it immediately.
+			if len(candidate.Content.Parts) > 0 {
+				reply := &Reply{
+					Text:          candidate.Content.Parts[0].Text,
+					FinishReason:  candidate.FinishReason,
+					SafetyRatings: candidate.SafetyRatings,
+				}
+				if usage := apiResponse.UsageMetadata; usage != nil {
+					reply.PromptTokens, reply.OutputTokens = usage.PromptTokenCount, usage.CandidatesTokenCount
+					Metrics.AITokens.Add(float64(usage.PromptTokenCount), guildID, "prompt")
+					Metrics.AITokens.Add(float64(usage.CandidatesTokenCount), guildID, "output")
+				}
+				return reply, nil
+			}
 		}
 
 		// If we reach here, the response was valid but empty.
 		lastError = fmt.Errorf("API returned a valid but empty response")
-		log.Println("API key worked, but response was empty. Trying next key.")
+		Metrics.AIKeyFailures.Inc("empty")
+		slog.Warn("API key worked, but the response was empty, trying next key", "guild", guildID, "key_index", i+1)
 	}
 
-	return "", fmt.Errorf("all available API keys failed. Last error: %w", lastError)
+	return nil, fmt.Errorf("all available API keys failed. Last error: %w", lastError)
+}
+
+// attempt traces one call with one of the server's keys.
+func (c *Client) attempt(ctx context.Context, keyIndex int, apiKey string, jsonData []byte) (*ApiResponse, error) {
+	ctx, span := Tracing.Start(ctx, "gemini.call", attribute.Int("gemini.key_index", keyIndex))
+	apiResponse, err := c.call(ctx, apiKey, jsonData)
+	if err != nil {
+		span.SetAttributes(attribute.String("gemini.failure", failureStatus(err)))
+	} else if usage := apiResponse.UsageMetadata; usage != nil {
+		span.SetAttributes(
+			attribute.Int64("gemini.prompt_tokens", usage.PromptTokenCount),
+			attribute.Int64("gemini.output_tokens", usage.CandidatesTokenCount),
+		)
+	}
+	Tracing.End(span, err)
+	return apiResponse, err
+}
+
+// call sends one generateContent request with one API key. Transport failures,
+// non-200 statuses and unparseable bodies are returned as errors; an error
+// object inside a 200 response is left for the caller.
+func (c *Client) call(ctx context.Context, apiKey string, jsonData []byte) (*ApiResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", generateURL, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("x-goog-api-key", apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	// Check for non-200 HTTP status codes first
+	if resp.StatusCode != http.StatusOK {
+		slog.Debug("Gemini error response", "status", resp.StatusCode, "body", string(body))
+		return nil, &statusError{code: resp.StatusCode, message: apiErrorMessage(body)}
+	}
+
+	// Parse the JSON response
+	var apiResponse ApiResponse
+	if err := json.Unmarshal(body, &apiResponse); err != nil {
+		slog.Debug("Unparseable Gemini response", "body", string(body))
+		return nil, fmt.Errorf("failed to parse API response: %w", err)
+	}
+	return &apiResponse, nil
+}
+
+// statusError is a Gemini call answered with a non-200 status.
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("API returned status %d: %s", e.code, e.message)
+}
+
+// failureStatus labels a failed call for metrics by its HTTP status, or
+// "transport" if there was no usable response.
+func failureStatus(err error) string {
+	var status *statusError
+	if errors.As(err, &status) {
+		return strconv.Itoa(status.code)
+	}
+	return "transport"
+}
+
+// result labels the outcome of generating a reply for metrics.
+func result(ctx context.Context, err error) string {
+	var blocked *BlockedError
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &blocked):
+		return "blocked"
+	case errors.Is(err, ErrNoAPIKeys):
+		return "no_keys"
+	case ctx.Err() != nil:
+		return "cancelled"
+	default:
+		return "error"
+	}
+}
+
+// Classification is the verdict of the second-pass classifier.
+type Classification struct {
+	Flagged    bool               `json:"flagged"`
+	Categories map[string]float64 `json:"categories"`
+	Reason     string             `json:"reason"`
+}
+
+const classifierInstruction = `
+You are a content safety classifier for a Discord bot. You never answer the text, you only rate it.
+Return a JSON object with these fields:
+"flagged": true if the text should not be posted in the given channel,
+"categories": an object mapping each of "harassment", "hate", "sexual", "violence", "self_harm" and "dangerous" to a score between 0 and 1,
+"reason": a short explanation.
+`
+
+// Classify runs the given text through a second model pass that rates it for safety.
+// The channel context (e.g. whether it is marked NSFW) is passed to the classifier.
+func (c *Client) Classify(ctx context.Context, guildID, channelContext, text string) (*Classification, error) {
+	requestBody := RequestBody{
+		SystemInstruction: SystemInstruction{
+			Parts: []Part{{Text: classifierInstruction}},
+		},
+		Contents: []Content{
+			{Parts: []Part{{Text: "Channel: " + channelContext + "\n\nText:\n" + text}}},
+		},
+		GenerationConfig: &GenerationConfig{ResponseMimeType: "application/json"},
+	}
+
+	reply, err := c.generate(ctx, guildID, requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var result Classification
+	if err := json.Unmarshal([]byte(reply.Text), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse classifier output: %w", err)
+	}
+	return &result, nil
 }
 
 // GetBasePersona provides access to the constant persona string.
@@ -158,3 +422,48 @@ func GetBasePersona() string {
 	persona := strings.Replace(basePersona, "{shape}", "Hellish Queen", -1)
 	return persona
 }
+
+// MessageScores rates an incoming user message for the auto-mod subsystem.
+type MessageScores struct {
+	Toxicity float64 `json:"toxicity"`
+	Spam     float64 `json:"spam"`
+	Scam     float64 `json:"scam"`
+	Reason   string  `json:"reason"`
+}
+
+const messageClassifierInstruction = `
+You are a moderation classifier for a Discord server. You never answer the message, you only rate it.
+Return a JSON object with these fields:
+"toxicity": a score between 0 and 1 for insults, harassment, hate or threats,
+"spam": a score between 0 and 1 for repetitive, promotional or flooding content,
+"scam": a score between 0 and 1 for scams, phishing links, fake giveaways or credential theft,
+"reason": a short explanation of the highest score.
+`
+
+// ClassifyMessage rates a user's message for toxicity, spam and scams. Safety
+// blocking is off, since the messages worth rating are the ones Gemini would
+// otherwise refuse; it may still return a BlockedError for content it always
+// blocks.
+func (c *Client) ClassifyMessage(ctx context.Context, guildID, text string) (*MessageScores, error) {
+	requestBody := RequestBody{
+		SystemInstruction: SystemInstruction{
+			Parts: []Part{{Text: messageClassifierInstruction}},
+		},
+		Contents: []Content{
+			{Parts: []Part{{Text: text}}},
+		},
+		GenerationConfig: &GenerationConfig{ResponseMimeType: "application/json"},
+		SafetySettings:   unfiltered,
+	}
+
+	reply, err := c.generate(ctx, guildID, requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var result MessageScores
+	if err := json.Unmarshal([]byte(reply.Text), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse classifier output: %w", err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,169 @@
+package Audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hellish/Database"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Snapshot is a flattened, redacted view of a server's configuration, keyed by
+// dotted field path (e.g. "moderation.blocked_words").
+type Snapshot map[string]string
+
+// secretFields are shown as fingerprints rather than values.
+var secretFields = map[string]bool{
+	"apilist.apikeys": true,
+}
+
+// hiddenFields are bookkeeping rather than settings and are left out entirely.
+var hiddenFields = map[string]bool{
+	"data_key": true,
+	"usage":    true,
+}
+
+// Take captures the current configuration of a server. Failures are logged and
+// yield an empty snapshot so that auditing never blocks a change.
+func Take(ctx context.Context, db *Database.DB, serverId string) Snapshot {
+	config, err := db.ViewServer(ctx, serverId)
+	if err != nil {
+		slog.Error("Error taking audit snapshot", "guild", serverId, "err", err)
+		return Snapshot{}
+	}
+	return FromConfig(ctx, config)
+}
+
+// FromConfig flattens a server's configuration into a snapshot.
+func FromConfig(ctx context.Context, config Database.User) Snapshot {
+	raw, err := bson.Marshal(config)
+	if err != nil {
+		return Snapshot{}
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return Snapshot{}
+	}
+
+	snapshot := Snapshot{}
+	decrypt := func(field, ciphertext string) (string, error) {
+		return config.Decrypt(ctx, field, ciphertext)
+	}
+	flatten(snapshot, decrypt, "", doc)
+	return snapshot
+}
+
+// Mirror receives every entry Record stores, for example to post it in the
+// server's audit channel. It logs its own failures.
+type Mirror func(ctx context.Context, entry *Database.AuditEntry)
+
+var mirror atomic.Pointer[Mirror]
+
+// SetMirror passes every entry stored from now on to m, whichever path the
+// change came through.
+func SetMirror(m Mirror) {
+	mirror.Store(&m)
+}
+
+// Record compares the configuration with an earlier snapshot and stores an audit
+// entry if anything changed, then hands it to the mirror. It returns the stored
+// entry, or nil if nothing changed.
+func Record(ctx context.Context, db *Database.DB, serverId, actorId, actorName, action string, before Snapshot) (*Database.AuditEntry, error) {
+	changes := Diff(before, Take(ctx, db, serverId))
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	entry := Database.AuditEntry{
+		ServerId:  serverId,
+		ActorId:   actorId,
+		ActorName: actorName,
+		Action:    action,
+		Changes:   changes,
+	}
+	if err := db.InsertAuditEntry(ctx, entry); err != nil {
+		return nil, err
+	}
+	slog.Info("Configuration changed", "guild", serverId, "actor", actorId, "actor_name", actorName, "action", action)
+	if m := mirror.Load(); m != nil {
+		(*m)(ctx, &entry)
+	}
+	return &entry, nil
+}
+
+// Diff lists the fields whose values differ between two snapshots, sorted by field.
+func Diff(before, after Snapshot) []Database.AuditChange {
+	fields := map[string]bool{}
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+
+	var changes []Database.AuditChange
+	for field := range fields {
+		if before[field] != after[field] {
+			changes = append(changes, Database.AuditChange{Field: field, Before: before[field], After: after[field]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// Fingerprint identifies a secret without revealing it.
+func Fingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "fp:" + hex.EncodeToString(sum[:])[:12]
+}
+
+func flatten(snapshot Snapshot, decrypt func(field, ciphertext string) (string, error), prefix string, value any) {
+	switch v := value.(type) {
+	case bson.M:
+		for key, inner := range v {
+			if prefix == "" && (key == "_id" || hiddenFields[key]) {
+				continue
+			}
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			flatten(snapshot, decrypt, path, inner)
+		}
+	case bson.A:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			text := fmt.Sprint(item)
+			if secretFields[prefix] {
+				text = fingerprintCiphertext(decrypt, prefix, text)
+			}
+			items = append(items, text)
+		}
+		sort.Strings(items)
+		snapshot[prefix] = strings.Join(items, ", ")
+	case nil:
+		snapshot[prefix] = ""
+	default:
+		text := fmt.Sprint(v)
+		if secretFields[prefix] {
+			text = fingerprintCiphertext(decrypt, prefix, text)
+		}
+		snapshot[prefix] = text
+	}
+}
+
+// fingerprintCiphertext decrypts a stored secret and fingerprints the plaintext,
+// since the same key encrypts to a different ciphertext every time.
+func fingerprintCiphertext(decrypt func(field, ciphertext string) (string, error), field string, ciphertext string) string {
+	plaintext, err := decrypt(field, ciphertext)
+	if err != nil {
+		return "fp:unreadable"
+	}
+	return Fingerprint(plaintext)
+}
@@ -0,0 +1,325 @@
+package Database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	serversBucket      = []byte("servers")
+	incidentsBucket    = []byte("incidents")
+	automodCasesBucket = []byte("automod_cases")
+	auditLogBucket     = []byte("audit_log")
+	usageBucket        = []byte("usage")
+)
+
+// BoltStore keeps everything in a single bbolt file, for single-node hosts that
+// don't want to run MongoDB. Documents are stored bson-encoded, like in MongoDB.
+type BoltStore struct {
+	db *bbolt.DB
+	// The file is locked to one process, so leases never leave it.
+	localLeases
+}
+
+// NewBoltStore opens (or creates) the database file at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open bolt database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{serversBucket, incidentsBucket, automodCasesBucket, auditLogBucket, usageBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not prepare bolt database: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// Ping fails once the database file has been closed.
+func (b *BoltStore) Ping(ctx context.Context) error {
+	return b.db.View(func(*bbolt.Tx) error { return nil })
+}
+
+func (b *BoltStore) FindServer(ctx context.Context, serverId string) (User, error) {
+	var result User
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		raw := tx.Bucket(serversBucket).Get([]byte(serverId))
+		if raw == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(raw, &result)
+	})
+	return result, err
+}
+
+func (b *BoltStore) UpdateServer(ctx context.Context, serverId string, update Update, upsert bool) (bool, error) {
+	var changed bool
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(serversBucket)
+		raw := bucket.Get([]byte(serverId))
+		if raw == nil && !upsert {
+			return nil
+		}
+		updated, c, err := applyUpdate(raw, serverId, update)
+		if err != nil {
+			return err
+		}
+		changed = c
+		return bucket.Put([]byte(serverId), updated)
+	})
+	return changed, err
+}
+
+func (b *BoltStore) InsertIncident(ctx context.Context, incident Incident) error {
+	return b.put(incidentsBucket, primitive.NewObjectID(), incident)
+}
+
+func (b *BoltStore) InsertAutoModCase(ctx context.Context, c AutoModCase) (string, error) {
+	if c.Id.IsZero() {
+		c.Id = primitive.NewObjectID()
+	}
+	return c.Id.Hex(), b.put(automodCasesBucket, c.Id, c)
+}
+
+func (b *BoltStore) FindAutoModCase(ctx context.Context, caseId string) (AutoModCase, error) {
+	id, err := primitive.ObjectIDFromHex(caseId)
+	if err != nil {
+		return AutoModCase{}, ErrNotFound
+	}
+
+	var result AutoModCase
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		raw := tx.Bucket(automodCasesBucket).Get(id[:])
+		if raw == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(raw, &result)
+	})
+	return result, err
+}
+
+func (b *BoltStore) UpdateAutoModCase(ctx context.Context, caseId string, expectedStatus string, fields map[string]any) error {
+	id, err := primitive.ObjectIDFromHex(caseId)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(automodCasesBucket)
+		raw := bucket.Get(id[:])
+		if raw == nil {
+			return ErrNotFound
+		}
+		var c AutoModCase
+		if err := bson.Unmarshal(raw, &c); err != nil {
+			return err
+		}
+		if c.Status != expectedStatus {
+			return ErrNotFound
+		}
+		updated, err := setCaseFields(c, fields)
+		if err != nil {
+			return err
+		}
+		encoded, err := bson.Marshal(updated)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(id[:], encoded)
+	})
+}
+
+func (b *BoltStore) InsertAuditEntry(ctx context.Context, entry AuditEntry) error {
+	return b.put(auditLogBucket, primitive.NewObjectID(), entry)
+}
+
+func (b *BoltStore) FindAuditEntries(ctx context.Context, serverId string, filter AuditFilter) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		// Keys are ObjectIDs, which sort by creation time, so walk backwards for newest first.
+		cursor := tx.Bucket(auditLogBucket).Cursor()
+		for k, v := cursor.Last(); k != nil && len(entries) < filter.limit(); k, v = cursor.Prev() {
+			var entry AuditEntry
+			if err := bson.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.ServerId == serverId && filter.Matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// usageKey is where a server's usage on a day is stored. Keys of one server
+// sort by day.
+func usageKey(serverId, day string) []byte {
+	return []byte(serverId + "/" + day)
+}
+
+// AddUsage also deletes the server's expired usage, since bbolt has no TTL.
+func (b *BoltStore) AddUsage(ctx context.Context, serverId string, day string, usage Usage) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(usageBucket)
+		// The server's keys before the cutoff day are all expired.
+		first, cutoff := usageKey(serverId, ""), usageKey(serverId, usageCutoff())
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(first); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = cursor.Seek(first) {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+
+		record := UsageRecord{ServerId: serverId, Day: day, ExpiresAt: usageExpiry(day)}
+		if raw := bucket.Get(usageKey(serverId, day)); raw != nil {
+			if err := bson.Unmarshal(raw, &record); err != nil {
+				return err
+			}
+		}
+		record.Replies += usage.Replies
+		record.PromptTokens += usage.PromptTokens
+		record.OutputTokens += usage.OutputTokens
+		encoded, err := bson.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(usageKey(serverId, day), encoded)
+	})
+}
+
+func (b *BoltStore) FindUsage(ctx context.Context, serverId string, since string) ([]UsageRecord, error) {
+	records := []UsageRecord{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		prefix := usageKey(serverId, "")
+		cursor := tx.Bucket(usageBucket).Cursor()
+		for k, v := cursor.Seek(usageKey(serverId, since)); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var record UsageRecord
+			if err := bson.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	slices.Reverse(records)
+	return records, err
+}
+
+// put stores a bson-encoded value under an ObjectID key.
+func (b *BoltStore) put(bucket []byte, id primitive.ObjectID, value any) error {
+	encoded, err := bson.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Put(id[:], encoded)
+	})
+}
+
+func (b *BoltStore) Export(ctx context.Context) (Dump, error) {
+	var dump Dump
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if err := exportBucket(tx, serversBucket, &dump.Servers); err != nil {
+			return err
+		}
+		if err := exportBucket(tx, incidentsBucket, &dump.Incidents); err != nil {
+			return err
+		}
+		if err := exportBucket(tx, automodCasesBucket, &dump.AutoModCases); err != nil {
+			return err
+		}
+		if err := exportBucket(tx, auditLogBucket, &dump.AuditLog); err != nil {
+			return err
+		}
+		return exportBucket(tx, usageBucket, &dump.Usage)
+	})
+	return dump, err
+}
+
+// exportBucket decodes every value in a bucket and appends it to out.
+func exportBucket[T any](tx *bbolt.Tx, bucket []byte, out *[]T) error {
+	return tx.Bucket(bucket).ForEach(func(_, v []byte) error {
+		var value T
+		if err := bson.Unmarshal(v, &value); err != nil {
+			return err
+		}
+		*out = append(*out, value)
+		return nil
+	})
+}
+
+// Migrate upgrades every server document below SchemaVersion. Server IDs are
+// the bucket keys, so there are no duplicates or indexes to take care of.
+func (b *BoltStore) Migrate(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	report := newMigrationReport(dryRun)
+	migrate := func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(serversBucket)
+		updated := map[string][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			var doc bson.M
+			if err := bson.Unmarshal(v, &doc); err != nil {
+				return fmt.Errorf("corrupt document for server %s: %w", k, err)
+			}
+			if !migrateDocument(doc, report) {
+				return nil
+			}
+			encoded, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = encoded
+			return nil
+		})
+		if err != nil || dryRun {
+			return err
+		}
+		// bbolt doesn't allow writes while iterating, so save them afterwards.
+		for k, v := range updated {
+			if err := bucket.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if dryRun {
+		err = b.db.View(migrate)
+	} else {
+		err = b.db.Update(migrate)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (b *BoltStore) ServerIDs(ctx context.Context) ([]string, error) {
+	var ids []string
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(serversBucket).ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
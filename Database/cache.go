@@ -0,0 +1,155 @@
+package Database
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Watcher is implemented by stores that can report changes made to server
+// documents by other processes, so caches in every replica stay consistent.
+type Watcher interface {
+	// WatchServers calls onChange with the ID of each server whose document
+	// changes, or with "" when it can't tell which one did. It blocks until ctx
+	// is cancelled or the watch fails.
+	WatchServers(ctx context.Context, onChange func(serverId string)) error
+}
+
+// CacheStats counts how the guild config cache has been used.
+type CacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Invalidations uint64 `json:"invalidations"`
+	Entries       int    `json:"entries"`
+}
+
+// CachedStore caches server documents in process memory in front of another
+// store, so each guild's config is loaded once instead of on every message.
+// Entries are dropped when written through this store, when the inner store
+// reports a change (see Watcher), or after the TTL as a safety net.
+type CachedStore struct {
+	Store
+
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[string]cacheEntry
+	// version is bumped on every invalidation so a load that raced with a
+	// write doesn't put stale data back into the cache.
+	version atomic.Uint64
+
+	hits, misses, invalidations atomic.Uint64
+	stopWatch                   context.CancelFunc
+}
+
+type cacheEntry struct {
+	server   User
+	found    bool
+	loadedAt time.Time
+}
+
+// NewCachedStore wraps a store with a guild config cache.
+func NewCachedStore(inner Store, ttl time.Duration) *CachedStore {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &CachedStore{
+		Store:     inner,
+		ttl:       ttl,
+		entries:   map[string]cacheEntry{},
+		stopWatch: cancel,
+	}
+	if watcher, ok := inner.(Watcher); ok {
+		go c.watch(ctx, watcher)
+	}
+	return c
+}
+
+func (c *CachedStore) FindServer(ctx context.Context, serverId string) (User, error) {
+	c.mu.RLock()
+	entry, ok := c.entries[serverId]
+	c.mu.RUnlock()
+
+	if ok && time.Since(entry.loadedAt) < c.ttl {
+		c.hits.Add(1)
+		if !entry.found {
+			return User{}, ErrNotFound
+		}
+		return entry.server, nil
+	}
+	c.misses.Add(1)
+
+	version := c.version.Load()
+	server, err := c.Store.FindServer(ctx, serverId)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return User{}, err
+	}
+
+	c.mu.Lock()
+	if c.version.Load() == version {
+		c.entries[serverId] = cacheEntry{server: server, found: err == nil, loadedAt: time.Now()}
+	}
+	c.mu.Unlock()
+	return server, err
+}
+
+func (c *CachedStore) UpdateServer(ctx context.Context, serverId string, update Update, upsert bool) (bool, error) {
+	changed, err := c.Store.UpdateServer(ctx, serverId, update, upsert)
+	c.Invalidate(serverId)
+	return changed, err
+}
+
+// Invalidate drops a server from the cache. An empty ID drops every server.
+func (c *CachedStore) Invalidate(serverId string) {
+	c.version.Add(1)
+	c.invalidations.Add(1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if serverId == "" {
+		c.entries = map[string]cacheEntry{}
+		return
+	}
+	delete(c.entries, serverId)
+}
+
+// Stats returns the cache's hit, miss and invalidation counts.
+func (c *CachedStore) Stats() CacheStats {
+	c.mu.RLock()
+	entries := len(c.entries)
+	c.mu.RUnlock()
+
+	return CacheStats{
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Invalidations: c.invalidations.Load(),
+		Entries:       entries,
+	}
+}
+
+func (c *CachedStore) Close() error {
+	c.stopWatch()
+	return c.Store.Close()
+}
+
+// watch follows the inner store's change feed, restarting it after failures.
+// Anything may have changed while the feed was down, so the cache is cleared
+// on every restart.
+func (c *CachedStore) watch(ctx context.Context, watcher Watcher) {
+	backoff := time.Second
+	for {
+		err := watcher.WatchServers(ctx, c.Invalidate)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("Guild cache change stream stopped, relying on the TTL until it reconnects", "ttl", c.ttl, "err", err)
+		c.Invalidate("")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 5*time.Minute)
+	}
+}
@@ -5,80 +5,305 @@ import (
 	"errors"
 	"fmt"
 	"hellish/crypto"
-	"log"
-	"os"
+	"log/slog"
+	"strings"
+	"sync"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// apiKeysField is where a server's encrypted API keys are stored.
+const apiKeysField = "apilist.apikeys"
+
+// ErrNotFound is returned by a Store when the requested document does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Errors from the API key commands that are meant to be shown to the user.
+var (
+	ErrDuplicateAPIKey = errors.New("API key is already in the list")
+	ErrAPIKeyNotFound  = errors.New("API key not found on this server")
+)
+
+// Store is a storage backend for server configuration and the records the bot
+// keeps about each server (moderation incidents, auto-mod cases, audit entries).
+type Store interface {
+	// FindServer returns a server's configuration document, or ErrNotFound.
+	FindServer(ctx context.Context, serverId string) (User, error)
+	// ServerIDs lists every server that has a configuration document.
+	ServerIDs(ctx context.Context) ([]string, error)
+	// UpdateServer applies an update to a server's document. With upsert set, a
+	// missing document is created first. It reports whether anything changed.
+	UpdateServer(ctx context.Context, serverId string, update Update, upsert bool) (bool, error)
+
+	InsertIncident(ctx context.Context, incident Incident) error
+
+	// InsertAutoModCase stores a case and returns its generated ID.
+	InsertAutoModCase(ctx context.Context, c AutoModCase) (string, error)
+	FindAutoModCase(ctx context.Context, caseId string) (AutoModCase, error)
+	// UpdateAutoModCase sets fields on a case only if it is in the expected
+	// status, and returns ErrNotFound otherwise.
+	UpdateAutoModCase(ctx context.Context, caseId string, expectedStatus string, fields map[string]any) error
+
+	InsertAuditEntry(ctx context.Context, entry AuditEntry) error
+	FindAuditEntries(ctx context.Context, serverId string, filter AuditFilter) ([]AuditEntry, error)
+
+	// AddUsage adds to a server's usage on a "2006-01-02" day, creating the
+	// day's record if needed.
+	AddUsage(ctx context.Context, serverId string, day string, usage Usage) error
+	// FindUsage returns a server's usage records from the since day on, newest first.
+	FindUsage(ctx context.Context, serverId string, since string) ([]UsageRecord, error)
+
+	// Ping checks that the store can be reached.
+	Ping(ctx context.Context) error
+
+	// Export returns a copy of everything in the store.
+	Export(ctx context.Context) (Dump, error)
+
+	// AcquireLease claims or renews a named lease for owner until ttl has
+	// passed, and reports whether owner holds it. Processes sharing the store
+	// use leases to split work such as gateway shards.
+	AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error)
+	// ReleaseLease drops a lease if owner holds it.
+	ReleaseLease(ctx context.Context, name, owner string) error
+
+	Close() error
+}
+
+// Dump is a portable copy of a store's contents, used to move between backends.
+// API keys stay encrypted, so the same ENCRYPTION_KEY is needed on both sides.
+type Dump struct {
+	Servers      []User        `json:"servers"`
+	Incidents    []Incident    `json:"incidents"`
+	AutoModCases []AutoModCase `json:"automod_cases"`
+	AuditLog     []AuditEntry  `json:"audit_log"`
+	Usage        []UsageRecord `json:"usage"`
+}
+
+// Update describes a change to a server document. Keys are dotted field paths
+// such as "moderation.blocked_words", matching the documents' bson field names.
+type Update struct {
+	Set      map[string]any
+	AddToSet map[string]any
+	Pull     map[string]any
+	// Inc adds to numeric fields, starting from zero if they are missing.
+	Inc map[string]int64
+	// Match limits the update to a document whose string fields hold these
+	// values, where a missing field counts as "". Writers that may race use it
+	// to compare and set. It can't be combined with upsert.
+	Match map[string]string
+}
+
 type User struct {
 	ServerId        string  `bson:"server_id"`
 	ServerData      string  `bson:"server_data"`
 	ApiList         ApiList `bson:"apilist"`
 	ActivateChannel string  `bson:"activate_channel"`
 	SystemMessage   string  `bson:"system_message"`
+	// Persona replaces the bot's built-in persona for the server when set.
+	Persona       string                `bson:"persona"`
+	Moderation    Moderation            `bson:"moderation"`
+	AutoMod       AutoMod               `bson:"automod"`
+	AuditChannel  string                `bson:"audit_channel"`
+	Permissions   map[string]Grant      `bson:"permissions"`
+	Access        AccessList            `bson:"access"`
+	ChannelAccess map[string]AccessList `bson:"channel_access"`
+	AccessNotice  bool                  `bson:"access_notice"`
+	SchemaVersion int                   `bson:"schema_version"`
+	// DataKey is the server's own encryption key for its secrets, wrapped by
+	// a master key provider.
+	DataKey string `bson:"data_key"`
+	// LegacyUsage is per-day usage as older versions stored it, keyed like
+	// "2006-01-02". Migrations move it into usage records (see UsageRecord).
+	LegacyUsage map[string]Usage `bson:"usage,omitempty" json:"usage,omitempty"`
+}
+
+// Decrypt decrypts a secret stored in one of the server's fields, given by its
+// dotted path. It fails if the secret was sealed for another server or field.
+func (u User) Decrypt(ctx context.Context, field string, encrypted string) (string, error) {
+	var dataKey []byte
+	if u.DataKey != "" {
+		var err error
+		if dataKey, err = crypto.UnwrapDataKey(ctx, u.DataKey); err != nil {
+			return "", err
+		}
+	}
+	return crypto.Open(dataKey, encrypted, u.ServerId, field)
+}
+
+// AccessList controls who may chat with the AI, either server-wide or in one channel.
+type AccessList struct {
+	AllowRoles []string `bson:"allow_roles"`
+	AllowUsers []string `bson:"allow_users"`
+	DenyRoles  []string `bson:"deny_roles"`
+	DenyUsers  []string `bson:"deny_users"`
+}
+
+// Grant lists the roles and users a capability has been granted to.
+type Grant struct {
+	Roles []string `bson:"roles"`
+	Users []string `bson:"users"`
 }
 type ApiList struct {
 	Apikeys []string `bson:"apikeys"`
 }
 
-var collection *mongo.Collection
-var client *mongo.Client
+// Moderation holds a server's output moderation settings.
+type Moderation struct {
+	BlockedWords    []string     `bson:"blocked_words"`
+	BlockedPatterns []string     `bson:"blocked_patterns"`
+	Classifier      bool         `bson:"classifier"`
+	LogChannel      string       `bson:"log_channel"`
+	Output          OutputPolicy `bson:"output"`
+}
 
-func ConnectDB() error {
-	mongoURL := os.Getenv("MONGO_URL")
-	if mongoURL == "" {
-		return fmt.Errorf("MONGO_URL environment variable not set")
-	}
-	clientOptions := options.Client().ApplyURI(mongoURL)
+// OutputPolicy controls how AI replies are cleaned up before they are posted.
+// The zero value is the strictest setting.
+type OutputPolicy struct {
+	// Mentions is who a reply may ping: "none", "author" (default) or "users".
+	Mentions         string `bson:"mentions"`
+	AllowInvites     bool   `bson:"allow_invites"`
+	AllowMaskedLinks bool   `bson:"allow_masked_links"`
+	// EmojiLimit caps emoji per reply. Zero uses the default, negative means no limit.
+	EmojiLimit int `bson:"emoji_limit"`
+	// RawMarkdown posts replies without closing unbalanced code blocks.
+	RawMarkdown bool `bson:"raw_markdown"`
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// Incident records a reply that was withheld by moderation.
+type Incident struct {
+	ServerId  string    `bson:"server_id"`
+	ChannelId string    `bson:"channel_id"`
+	UserId    string    `bson:"user_id"`
+	Source    string    `bson:"source"`
+	Reason    string    `bson:"reason"`
+	Excerpt   string    `bson:"excerpt"`
+	CreatedAt time.Time `bson:"created_at"`
+}
 
-	var err error
-	client, err = mongo.Connect(ctx, clientOptions)
-	if err != nil {
-		return fmt.Errorf("could not connect to MongoDB: %w", err)
-	}
+// AutoMod holds a server's input moderation settings. Thresholds and actions are
+// keyed by category ("toxicity", "spam" or "scam").
+type AutoMod struct {
+	Enabled        bool               `bson:"enabled"`
+	Channels       []string           `bson:"channels"`
+	Thresholds     map[string]float64 `bson:"thresholds"`
+	Actions        map[string]string  `bson:"actions"`
+	TimeoutMinutes int                `bson:"timeout_minutes"`
+	LogChannel     string             `bson:"log_channel"`
+}
 
-	if err := client.Ping(ctx, nil); err != nil {
-		return fmt.Errorf("could not ping MongoDB: %w", err)
-	}
+// AutoModCase records an action the auto-mod took against a user and any appeal of it.
+type AutoModCase struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty"`
+	ServerId   string             `bson:"server_id"`
+	ChannelId  string             `bson:"channel_id"`
+	UserId     string             `bson:"user_id"`
+	Category   string             `bson:"category"`
+	Score      float64            `bson:"score"`
+	Action     string             `bson:"action"`
+	Reason     string             `bson:"reason"`
+	Content    string             `bson:"content"`
+	Status     string             `bson:"status"` // "open", "appealed", "accepted" or "denied"
+	Appeal     string             `bson:"appeal"`
+	ResolvedBy string             `bson:"resolved_by"`
+	CreatedAt  time.Time          `bson:"created_at"`
+	UpdatedAt  time.Time          `bson:"updated_at"`
+}
 
-	collection = client.Database("Hellish").Collection("users")
-	log.Println("Successfully connected to MongoDB!")
-	return nil
+// AuditEntry records a configuration change made to a server.
+type AuditEntry struct {
+	ServerId  string        `bson:"server_id"`
+	ActorId   string        `bson:"actor_id"`
+	ActorName string        `bson:"actor_name"`
+	Action    string        `bson:"action"`
+	Changes   []AuditChange `bson:"changes"`
+	CreatedAt time.Time     `bson:"created_at"`
+}
+
+// AuditChange is a single field's value before and after a change. Secrets are
+// never stored here, only their fingerprints.
+type AuditChange struct {
+	Field  string `bson:"field"`
+	Before string `bson:"before"`
+	After  string `bson:"after"`
 }
 
-// DisconnectDB should be called when your application is shutting down.
-func DisconnectDB() {
-	if client != nil {
-		log.Println("Disconnecting from MongoDB...")
-		if err := client.Disconnect(context.Background()); err != nil {
-			log.Printf("Error disconnecting from MongoDB: %v", err)
+// AuditFilter narrows down FindAuditEntries. Empty fields match everything.
+type AuditFilter struct {
+	ActorId string
+	Action  string // prefix match, e.g. "api" matches "api.add"
+	Field   string // prefix match on any changed field
+	Limit   int64
+}
+
+// Matches reports whether an audit entry passes the filter.
+func (f AuditFilter) Matches(entry AuditEntry) bool {
+	if f.ActorId != "" && entry.ActorId != f.ActorId {
+		return false
+	}
+	if f.Action != "" && !strings.HasPrefix(entry.Action, f.Action) {
+		return false
+	}
+	if f.Field != "" {
+		for _, change := range entry.Changes {
+			if strings.HasPrefix(change.Field, f.Field) {
+				return true
+			}
 		}
+		return false
 	}
+	return true
 }
 
-// FindChannel finds the activated channel for a given server ID.
-func FindChannel(serverID string) (string, error) {
-	if collection == nil {
-		return "", fmt.Errorf("database not initialized, call ConnectDB first")
+// limit returns the filter's limit, defaulting to 10 entries.
+func (f AuditFilter) limit() int {
+	if f.Limit <= 0 {
+		return 10
 	}
+	return int(f.Limit)
+}
 
-	// Create a new context for this specific operation.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// DB provides the operations the bot performs on top of a Store.
+type DB struct {
+	store Store
+	// dataKeyMu keeps concurrent commands from creating two data keys for a server.
+	dataKeyMu sync.Mutex
+}
+
+// New returns a DB backed by the given store.
+func New(store Store) *DB {
+	return &DB{store: store}
+}
+
+// Close closes the underlying store.
+func (db *DB) Close() error {
+	return db.store.Close()
+}
+
+// Ping checks that the database can be reached.
+func (db *DB) Ping(ctx context.Context) error {
+	return db.store.Ping(ctx)
+}
 
-	var result User
+// ViewServer retrieves the whole configuration document for a server.
+// A server without a document yields an empty configuration.
+func (db *DB) ViewServer(ctx context.Context, serverId string) (User, error) {
+	result, err := db.store.FindServer(ctx, serverId)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return User{ServerId: serverId}, nil
+		}
+		return User{}, fmt.Errorf("error finding server config: %w", err)
+	}
+	return result, nil
+}
 
-	err := collection.FindOne(ctx, bson.M{"server_id": serverID}).Decode(&result)
+// FindChannel finds the activated channel for a given server ID.
+func (db *DB) FindChannel(ctx context.Context, serverID string) (string, error) {
+	result, err := db.store.FindServer(ctx, serverID)
 	if err != nil {
 		// Handle the case where no document was found.
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, ErrNotFound) {
 			return "", fmt.Errorf("no configuration found for server ID: %s", serverID)
 		}
 		// Handle other potential errors.
@@ -91,70 +316,44 @@ func FindChannel(serverID string) (string, error) {
 
 	return result.ActivateChannel, nil
 }
-func InsertChannel(serverId string, channelId string) error {
-	if collection == nil {
-		return fmt.Errorf("database not initialized, call ConnectDB first")
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	filter := bson.D{{"server_id", serverId}}
-	update := bson.M{"$set": bson.M{"activate_channel": channelId}}
-	opts := options.Update().SetUpsert(true)
-	result, err1 := collection.UpdateOne(ctx, filter, update, opts)
-	fmt.Println(result)
-	if err1 != nil {
-		return err1
-	}
-	return nil
 
+func (db *DB) InsertChannel(ctx context.Context, serverId string, channelId string) error {
+	return db.setField(ctx, serverId, "activate_channel", channelId)
 }
 
-// AddAPIKey adds a new API key to a server's list using an upsert operation.
-func AddAPIKey(serverId string, apiKey string) error {
-	if collection == nil {
-		return fmt.Errorf("database not initialized")
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	encryptedKey, err := crypto.Encrypt(apiKey)
+// AddAPIKey encrypts an API key and adds it to a server's list.
+func (db *DB) AddAPIKey(ctx context.Context, serverId string, apiKey string) error {
+	keys, err := db.APIKeys(ctx, serverId)
 	if err != nil {
 		return err
 	}
-	filter := bson.M{"server_id": serverId}
-	// Use $addToSet to add the new key to the apikeys array only if it's not already present.
-	update := bson.M{
-		"$addToSet": bson.M{"apilist.apikeys": encryptedKey},
-		"$setOnInsert": bson.M{ // Set default fields only if the document is new
-			"server_id":        serverId,
-			"activate_channel": "",
-			"server_data":      "",
-			"system_message":   "",
-		},
+	// Ciphertexts differ on every encryption, so duplicates are found by decrypting.
+	for _, key := range keys {
+		if key == apiKey {
+			return ErrDuplicateAPIKey
+		}
 	}
-	opts := options.Update().SetUpsert(true)
 
-	_, err = collection.UpdateOne(ctx, filter, update, opts)
+	dataKey, err := db.DataKey(ctx, serverId)
 	if err != nil {
+		return err
+	}
+	encryptedKey, err := crypto.Seal(dataKey, apiKey, serverId, apiKeysField)
+	if err != nil {
+		return err
+	}
+	update := Update{AddToSet: map[string]any{apiKeysField: encryptedKey}}
+	if _, err := db.store.UpdateServer(ctx, serverId, update, true); err != nil {
 		return fmt.Errorf("failed to add API key: %w", err)
 	}
 	return nil
 }
 
-// ViewAPIKeys retrieves all API keys for a given server.
-func ViewAPIKeys(serverId string) ([]string, error) {
-	if collection == nil {
-		return nil, fmt.Errorf("database not initialized")
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	var result User
-	filter := bson.M{"server_id": serverId}
-	err := collection.FindOne(ctx, filter).Decode(&result)
-
+// ViewAPIKeys retrieves all encrypted API keys for a given server.
+func (db *DB) ViewAPIKeys(ctx context.Context, serverId string) ([]string, error) {
+	result, err := db.store.FindServer(ctx, serverId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, ErrNotFound) {
 			return []string{}, nil
 		}
 		return nil, fmt.Errorf("error finding server config: %w", err)
@@ -168,96 +367,377 @@ func ViewAPIKeys(serverId string) ([]string, error) {
 	return result.ApiList.Apikeys, nil
 }
 
-// RemoveAPIKey removes a specific API key from a server's list.
-func RemoveAPIKey(serverId string, apiKey string) error {
-	if collection == nil {
-		return fmt.Errorf("database not initialized")
+// APIKeys decrypts all API keys for a given server. Keys that were copied in
+// from another server, or rejected as unbound, are logged and skipped.
+func (db *DB) APIKeys(ctx context.Context, serverId string) ([]string, error) {
+	server, err := db.ViewServer(ctx, serverId)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(server.ApiList.Apikeys))
+	for i, key := range server.ApiList.Apikeys {
+		plaintext, err := server.Decrypt(ctx, apiKeysField, key)
+		if errors.Is(err, crypto.ErrMisplaced) || errors.Is(err, crypto.ErrUnbound) {
+			slog.Warn("Skipping API key", "guild", serverId, "key_index", i+1, "err", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, plaintext)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	return keys, nil
+}
+
+// DataKey returns a server's data key, creating and storing one if the server
+// has none yet. Only the first data key stored for a server is ever used, even
+// when several processes create one at once.
+func (db *DB) DataKey(ctx context.Context, serverId string) ([]byte, error) {
+	db.dataKeyMu.Lock()
+	defer db.dataKeyMu.Unlock()
 
-	filter := bson.M{"server_id": serverId}
-	encrptedKey, err := crypto.Encrypt(apiKey)
+	server, err := db.ViewServer(ctx, serverId)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if server.DataKey != "" {
+		return crypto.UnwrapDataKey(ctx, server.DataKey)
 	}
-	update := bson.M{"$pull": bson.M{"apilist.apikeys": encrptedKey}}
 
-	res, err := collection.UpdateOne(ctx, filter, update)
+	dataKey, wrapped, err := crypto.NewDataKey(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to remove API key: %w", err)
+		return nil, err
+	}
+	// The conditional write below can't create the document.
+	if _, err := db.store.UpdateServer(ctx, serverId, Update{}, true); err != nil {
+		return nil, fmt.Errorf("failed to store data key: %w", err)
+	}
+	stored, err := storeDataKey(ctx, db.store, serverId, "", wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if stored {
+		return dataKey, nil
 	}
 
-	if res.ModifiedCount == 0 {
-		return fmt.Errorf("API key not found on this server")
+	// Another process stored a data key first, so secrets are sealed with theirs.
+	if server, err = db.ViewServer(ctx, serverId); err != nil {
+		return nil, err
 	}
+	if server.DataKey == "" {
+		return nil, fmt.Errorf("failed to store data key for server %s", serverId)
+	}
+	return crypto.UnwrapDataKey(ctx, server.DataKey)
+}
 
-	return nil
+// storeDataKey replaces a server's wrapped data key, but only if it is still
+// previous ("" for none), so concurrent writers never replace a data key that
+// secrets may already be sealed with. It reports whether it stored the key.
+func storeDataKey(ctx context.Context, store Store, serverId string, previous, wrapped string) (bool, error) {
+	update := Update{
+		Set:   map[string]any{"data_key": wrapped},
+		Match: map[string]string{"data_key": previous},
+	}
+	stored, err := store.UpdateServer(ctx, serverId, update, false)
+	if err != nil {
+		return false, fmt.Errorf("failed to save data key: %w", err)
+	}
+	return stored, nil
+}
+
+// RemoveAPIKey removes a specific API key from a server's list.
+func (db *DB) RemoveAPIKey(ctx context.Context, serverId string, apiKey string) error {
+	server, err := db.ViewServer(ctx, serverId)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range server.ApiList.Apikeys {
+		plaintext, err := server.Decrypt(ctx, apiKeysField, key)
+		if err != nil || plaintext != apiKey {
+			continue
+		}
+		update := Update{Pull: map[string]any{apiKeysField: key}}
+		if _, err := db.store.UpdateServer(ctx, serverId, update, false); err != nil {
+			return fmt.Errorf("failed to remove API key: %w", err)
+		}
+		return nil
+	}
+
+	return ErrAPIKeyNotFound
 }
 
 // ClearAPIKeys removes all API keys for a server by setting the array to empty.
-func ClearAPIKeys(serverId string) error {
-	if collection == nil {
-		return fmt.Errorf("database not initialized")
+func (db *DB) ClearAPIKeys(ctx context.Context, serverId string) error {
+	update := Update{Set: map[string]any{apiKeysField: []string{}}}
+	if _, err := db.store.UpdateServer(ctx, serverId, update, false); err != nil {
+		return fmt.Errorf("failed to clear API keys: %w", err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	return nil
+}
 
-	filter := bson.M{"server_id": serverId}
-	update := bson.M{"$set": bson.M{"apilist.apikeys": []string{}}}
+func (db *DB) InsertSystemMessage(ctx context.Context, serverId string, message string) error {
+	return db.setField(ctx, serverId, "system_message", message)
+}
 
-	_, err := collection.UpdateOne(ctx, filter, update)
+func (db *DB) ViewSystemMessage(ctx context.Context, serverId string) (string, error) {
+	result, err := db.store.FindServer(ctx, serverId)
 	if err != nil {
-		return fmt.Errorf("failed to clear API keys: %w", err)
+		if errors.Is(err, ErrNotFound) {
+			return "", nil
+		}
+		return "", fmt.Errorf("error finding system message: %w", err)
+	}
+
+	return result.SystemMessage, nil
+}
+
+// SetPersona sets the persona that replaces the built-in one. An empty persona
+// restores the built-in one.
+func (db *DB) SetPersona(ctx context.Context, serverId string, persona string) error {
+	return db.setField(ctx, serverId, "persona", persona)
+}
+
+// ViewModeration retrieves the moderation settings for a given server.
+func (db *DB) ViewModeration(ctx context.Context, serverId string) (Moderation, error) {
+	result, err := db.ViewServer(ctx, serverId)
+	if err != nil {
+		return Moderation{}, err
+	}
+	return result.Moderation, nil
+}
+
+// AddBlockedWord adds a word to the server's blocked word list.
+func (db *DB) AddBlockedWord(ctx context.Context, serverId string, word string) error {
+	return db.addToList(ctx, serverId, "moderation.blocked_words", word)
+}
+
+// RemoveBlockedWord removes a word from the server's blocked word list.
+func (db *DB) RemoveBlockedWord(ctx context.Context, serverId string, word string) error {
+	return db.removeFromList(ctx, serverId, "moderation.blocked_words", word)
+}
+
+// AddBlockedPattern adds a regular expression to the server's blocked pattern list.
+func (db *DB) AddBlockedPattern(ctx context.Context, serverId string, pattern string) error {
+	return db.addToList(ctx, serverId, "moderation.blocked_patterns", pattern)
+}
+
+// RemoveBlockedPattern removes a regular expression from the server's blocked pattern list.
+func (db *DB) RemoveBlockedPattern(ctx context.Context, serverId string, pattern string) error {
+	return db.removeFromList(ctx, serverId, "moderation.blocked_patterns", pattern)
+}
+
+// SetClassifier enables or disables the second-pass classifier for a server.
+func (db *DB) SetClassifier(ctx context.Context, serverId string, enabled bool) error {
+	return db.setField(ctx, serverId, "moderation.classifier", enabled)
+}
+
+// SetModerationLogChannel sets the channel where moderation incidents are reported.
+// An empty channel ID disables reporting.
+func (db *DB) SetModerationLogChannel(ctx context.Context, serverId string, channelId string) error {
+	return db.setField(ctx, serverId, "moderation.log_channel", channelId)
+}
+
+// SetOutputPolicy sets one field of the server's output policy, given by its
+// bson name, e.g. "mentions".
+func (db *DB) SetOutputPolicy(ctx context.Context, serverId string, field string, value any) error {
+	return db.setField(ctx, serverId, "moderation.output."+field, value)
+}
+
+// InsertIncident stores a moderation incident.
+func (db *DB) InsertIncident(ctx context.Context, incident Incident) error {
+	if incident.CreatedAt.IsZero() {
+		incident.CreatedAt = time.Now().UTC()
+	}
+	if err := db.store.InsertIncident(ctx, incident); err != nil {
+		return fmt.Errorf("failed to insert incident: %w", err)
 	}
 	return nil
 }
 
-func InsertSystemMessage(serverId string, message string) error {
-	if collection == nil {
-		return fmt.Errorf("database not initialized")
+// ViewAutoMod retrieves the auto-mod settings for a given server.
+func (db *DB) ViewAutoMod(ctx context.Context, serverId string) (AutoMod, error) {
+	result, err := db.ViewServer(ctx, serverId)
+	if err != nil {
+		return AutoMod{}, err
+	}
+	return result.AutoMod, nil
+}
+
+// SetAutoModEnabled turns the auto-mod on or off for a server.
+func (db *DB) SetAutoModEnabled(ctx context.Context, serverId string, enabled bool) error {
+	return db.setField(ctx, serverId, "automod.enabled", enabled)
+}
+
+// AddAutoModChannel adds a channel to the set of channels the auto-mod watches.
+func (db *DB) AddAutoModChannel(ctx context.Context, serverId string, channelId string) error {
+	return db.addToList(ctx, serverId, "automod.channels", channelId)
+}
+
+// RemoveAutoModChannel stops the auto-mod from watching a channel.
+func (db *DB) RemoveAutoModChannel(ctx context.Context, serverId string, channelId string) error {
+	return db.removeFromList(ctx, serverId, "automod.channels", channelId)
+}
+
+// SetAutoModThreshold sets the score at which a category triggers its action.
+func (db *DB) SetAutoModThreshold(ctx context.Context, serverId string, category string, threshold float64) error {
+	return db.setField(ctx, serverId, "automod.thresholds."+category, threshold)
+}
+
+// SetAutoModAction sets the action taken when a category crosses its threshold.
+func (db *DB) SetAutoModAction(ctx context.Context, serverId string, category string, action string) error {
+	return db.setField(ctx, serverId, "automod.actions."+category, action)
+}
+
+// SetAutoModTimeout sets how long the timeout action lasts.
+func (db *DB) SetAutoModTimeout(ctx context.Context, serverId string, minutes int) error {
+	return db.setField(ctx, serverId, "automod.timeout_minutes", minutes)
+}
+
+// SetAutoModLogChannel sets the mod channel where auto-mod actions and appeals are posted.
+func (db *DB) SetAutoModLogChannel(ctx context.Context, serverId string, channelId string) error {
+	return db.setField(ctx, serverId, "automod.log_channel", channelId)
+}
+
+// InsertAutoModCase stores a new auto-mod case and returns its ID.
+func (db *DB) InsertAutoModCase(ctx context.Context, c AutoModCase) (string, error) {
+	now := time.Now().UTC()
+	c.Id = primitive.NewObjectID()
+	c.CreatedAt, c.UpdatedAt = now, now
+	if c.Status == "" {
+		c.Status = "open"
+	}
+	id, err := db.store.InsertAutoModCase(ctx, c)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert auto-mod case: %w", err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	return id, nil
+}
 
-	filter := bson.M{"server_id": serverId}
-	// Use $set to update the message, and $setOnInsert to create default fields if the document is new.
-	// This is a single, atomic, and efficient database operation.
-	update := bson.M{
-		"$set": bson.M{"system_message": message},
-		"$setOnInsert": bson.M{
-			"server_id":        serverId,
-			"activate_channel": "",
-			"server_data":      "",
-			"apilist":          ApiList{Apikeys: []string{}},
-		},
+// FindAutoModCase retrieves an auto-mod case by ID.
+func (db *DB) FindAutoModCase(ctx context.Context, caseId string) (AutoModCase, error) {
+	result, err := db.store.FindAutoModCase(ctx, caseId)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return AutoModCase{}, fmt.Errorf("no auto-mod case found with ID: %s", caseId)
+		}
+		return AutoModCase{}, fmt.Errorf("error finding auto-mod case: %w", err)
 	}
-	opts := options.Update().SetUpsert(true)
+	return result, nil
+}
+
+// AppealAutoModCase attaches a user's appeal to an open case.
+func (db *DB) AppealAutoModCase(ctx context.Context, caseId string, appeal string) error {
+	return db.updateAutoModCase(ctx, caseId, "open", map[string]any{"status": "appealed", "appeal": appeal})
+}
+
+// ResolveAutoModCase records a moderator's decision on an appealed case.
+// The status must be "accepted" or "denied".
+func (db *DB) ResolveAutoModCase(ctx context.Context, caseId string, status string, moderatorId string) error {
+	return db.updateAutoModCase(ctx, caseId, "appealed", map[string]any{"status": status, "resolved_by": moderatorId})
+}
 
-	_, err := collection.UpdateOne(ctx, filter, update, opts)
+// updateAutoModCase applies fields to a case only if it is still in the expected status,
+// so an appeal can't be submitted or resolved twice.
+func (db *DB) updateAutoModCase(ctx context.Context, caseId string, expectedStatus string, fields map[string]any) error {
+	fields["updated_at"] = time.Now().UTC()
+	err := db.store.UpdateAutoModCase(ctx, caseId, expectedStatus, fields)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("auto-mod case is not %s", expectedStatus)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to upsert system message: %w", err)
+		return fmt.Errorf("failed to update auto-mod case: %w", err)
 	}
 	return nil
 }
 
-func ViewSystemMessage(serverId string) (string, error) {
-	if collection == nil {
-		return "", fmt.Errorf("database not initialized")
+// GrantCapability grants a capability to a role or user. Kind must be "roles" or "users".
+func (db *DB) GrantCapability(ctx context.Context, serverId string, capability string, kind string, id string) error {
+	return db.addToList(ctx, serverId, "permissions."+capability+"."+kind, id)
+}
+
+// RevokeCapability revokes a capability from a role or user. Kind must be "roles" or "users".
+func (db *DB) RevokeCapability(ctx context.Context, serverId string, capability string, kind string, id string) error {
+	return db.removeFromList(ctx, serverId, "permissions."+capability+"."+kind, id)
+}
+
+// AddAccessEntry adds a role or user ID to one of a server's access lists. An empty
+// channel ID targets the server-wide list. The list must be "allow_roles",
+// "allow_users", "deny_roles" or "deny_users".
+func (db *DB) AddAccessEntry(ctx context.Context, serverId string, channelId string, list string, id string) error {
+	return db.addToList(ctx, serverId, accessPath(channelId, list), id)
+}
+
+// RemoveAccessEntry removes a role or user ID from one of a server's access lists.
+func (db *DB) RemoveAccessEntry(ctx context.Context, serverId string, channelId string, list string, id string) error {
+	return db.removeFromList(ctx, serverId, accessPath(channelId, list), id)
+}
+
+// SetAccessNotice sets whether users are told when the AI ignores them.
+func (db *DB) SetAccessNotice(ctx context.Context, serverId string, enabled bool) error {
+	return db.setField(ctx, serverId, "access_notice", enabled)
+}
+
+func accessPath(channelId string, list string) string {
+	if channelId == "" {
+		return "access." + list
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	return "channel_access." + channelId + "." + list
+}
 
-	var result User
-	filter := bson.M{"server_id": serverId}
-	err := collection.FindOne(ctx, filter).Decode(&result)
+// SetAuditChannel sets the channel where audit entries are mirrored.
+// An empty channel ID disables mirroring.
+func (db *DB) SetAuditChannel(ctx context.Context, serverId string, channelId string) error {
+	return db.setField(ctx, serverId, "audit_channel", channelId)
+}
+
+// InsertAuditEntry stores an audit entry.
+func (db *DB) InsertAuditEntry(ctx context.Context, entry AuditEntry) error {
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+	if err := db.store.InsertAuditEntry(ctx, entry); err != nil {
+		return fmt.Errorf("failed to insert audit entry: %w", err)
+	}
+	return nil
+}
 
+// FindAuditEntries returns a server's most recent audit entries matching the filter, newest first.
+func (db *DB) FindAuditEntries(ctx context.Context, serverId string, filter AuditFilter) ([]AuditEntry, error) {
+	entries, err := db.store.FindAuditEntries(ctx, serverId, filter)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return "", nil
-		}
-		return "", fmt.Errorf("error finding system message: %w", err)
+		return nil, fmt.Errorf("error finding audit entries: %w", err)
 	}
+	return entries, nil
+}
 
-	return result.SystemMessage, nil
+// addToList adds a value to an array field of a server's document, creating the document if needed.
+func (db *DB) addToList(ctx context.Context, serverId string, field string, value string) error {
+	update := Update{AddToSet: map[string]any{field: value}}
+	if _, err := db.store.UpdateServer(ctx, serverId, update, true); err != nil {
+		return fmt.Errorf("failed to update %s: %w", field, err)
+	}
+	return nil
+}
+
+// removeFromList removes a value from an array field of a server's document.
+func (db *DB) removeFromList(ctx context.Context, serverId string, field string, value string) error {
+	update := Update{Pull: map[string]any{field: value}}
+	modified, err := db.store.UpdateServer(ctx, serverId, update, false)
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", field, err)
+	}
+	if !modified {
+		return fmt.Errorf("value not found in %s", field)
+	}
+	return nil
+}
+
+// setField sets a single field of a server's document, creating the document if needed.
+func (db *DB) setField(ctx context.Context, serverId string, field string, value any) error {
+	update := Update{Set: map[string]any{field: value}}
+	if _, err := db.store.UpdateServer(ctx, serverId, update, true); err != nil {
+		return fmt.Errorf("failed to update %s: %w", field, err)
+	}
+	return nil
 }
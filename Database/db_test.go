@@ -0,0 +1,234 @@
+package Database
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"hellish/crypto"
+)
+
+// newTestDB returns a DB on an empty MemoryStore, with an env master key.
+func newTestDB(t *testing.T) (*DB, *MemoryStore) {
+	t.Helper()
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("ab", 32))
+	t.Setenv("ENCRYPTION_KEYS", "")
+	t.Setenv("ENCRYPTION_KEYFILE", "")
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("KMS", "")
+	if err := crypto.Init(); err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	return New(store), store
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestDB(t)
+
+	for _, key := range []string{"sk-first", "sk-second"} {
+		if err := db.AddAPIKey(ctx, "1", key); err != nil {
+			t.Fatalf("AddAPIKey(%q): %v", key, err)
+		}
+	}
+	if err := db.AddAPIKey(ctx, "1", "sk-first"); !errors.Is(err, ErrDuplicateAPIKey) {
+		t.Errorf("adding a key twice returned %v, want ErrDuplicateAPIKey", err)
+	}
+
+	stored, err := db.ViewAPIKeys(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("%d keys stored, want 2", len(stored))
+	}
+	for _, key := range stored {
+		if strings.Contains(key, "sk-") {
+			t.Errorf("key stored in plaintext: %q", key)
+		}
+	}
+
+	keys, err := db.APIKeys(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if want := []string{"sk-first", "sk-second"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("APIKeys = %q, want %q", keys, want)
+	}
+	// Keys are sealed for their server.
+	if keys, err := db.APIKeys(ctx, "2"); err != nil || len(keys) != 0 {
+		t.Errorf("APIKeys of another server = %q, %v, want none", keys, err)
+	}
+
+	if err := db.RemoveAPIKey(ctx, "1", "sk-first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RemoveAPIKey(ctx, "1", "sk-first"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("removing a missing key returned %v, want ErrAPIKeyNotFound", err)
+	}
+	if keys, err := db.APIKeys(ctx, "1"); err != nil || !reflect.DeepEqual(keys, []string{"sk-second"}) {
+		t.Errorf("APIKeys after removal = %q, %v, want [sk-second]", keys, err)
+	}
+
+	if err := db.ClearAPIKeys(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := db.APIKeys(ctx, "1"); err != nil || len(keys) != 0 {
+		t.Errorf("APIKeys after clearing = %q, %v, want none", keys, err)
+	}
+}
+
+func TestModeration(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestDB(t)
+
+	for _, word := range []string{"spoiler", "spoiler", "scam"} {
+		if err := db.AddBlockedWord(ctx, "1", word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddBlockedPattern(ctx, "1", `free\s+nitro`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetClassifier(ctx, "1", true); err != nil {
+		t.Fatal(err)
+	}
+
+	moderation, err := db.ViewModeration(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"spoiler", "scam"}; !reflect.DeepEqual(moderation.BlockedWords, want) {
+		t.Errorf("blocked words = %q, want %q", moderation.BlockedWords, want)
+	}
+	if want := []string{`free\s+nitro`}; !reflect.DeepEqual(moderation.BlockedPatterns, want) {
+		t.Errorf("blocked patterns = %q, want %q", moderation.BlockedPatterns, want)
+	}
+	if !moderation.Classifier {
+		t.Error("classifier not enabled")
+	}
+
+	if err := db.RemoveBlockedWord(ctx, "1", "spoiler"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RemoveBlockedWord(ctx, "1", "spoiler"); err == nil {
+		t.Error("removing a word that isn't blocked succeeded")
+	}
+	if err := db.RemoveBlockedPattern(ctx, "1", `free\s+nitro`); err != nil {
+		t.Fatal(err)
+	}
+	moderation, err = db.ViewModeration(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moderation.BlockedWords) != 1 || len(moderation.BlockedPatterns) != 0 {
+		t.Errorf("after removal: words %q, patterns %q", moderation.BlockedWords, moderation.BlockedPatterns)
+	}
+}
+
+func TestDataKey(t *testing.T) {
+	ctx := context.Background()
+	db, store := newTestDB(t)
+
+	first, err := db.DataKey(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := store.FindServer(ctx, "1")
+	if err != nil {
+		t.Fatalf("no document stored with the data key: %v", err)
+	}
+	if !strings.HasPrefix(server.DataKey, "env:") {
+		t.Errorf("stored data key %q isn't wrapped by the env provider", server.DataKey)
+	}
+	if bytes.Contains([]byte(server.DataKey), first) {
+		t.Error("data key stored unwrapped")
+	}
+
+	again, err := db.DataKey(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, again) {
+		t.Error("a second call created another data key")
+	}
+
+	// A data key that is already stored is never replaced.
+	_, wrapped, err := crypto.NewDataKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := storeDataKey(ctx, store, "1", "", wrapped); err != nil || stored {
+		t.Errorf("storeDataKey over an existing key = %v, %v, want false", stored, err)
+	}
+	if other, err := db.DataKey(ctx, "2"); err != nil || bytes.Equal(other, first) {
+		t.Errorf("DataKey of another server = %x, %v, want a different key", other, err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	db, source := newTestDB(t)
+
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := db.AddAPIKey(ctx, "1", "sk-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddBlockedWord(ctx, "1", "spoiler"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetPersona(ctx, "2", "pirate"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertIncident(ctx, Incident{ServerId: "1", Reason: "blocked word", CreatedAt: created}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.InsertAutoModCase(ctx, AutoModCase{ServerId: "1", Category: "spam", Status: "open", CreatedAt: created}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertAuditEntry(ctx, AuditEntry{ServerId: "1", Action: "persona", CreatedAt: created}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordUsage(ctx, "1", 10, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	dump, err := source.Export(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := NewMemoryStore()
+	if err := Import(ctx, target, dump); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := target.Export(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sortDump(&dump)
+	sortDump(&copied)
+	if !reflect.DeepEqual(dump, copied) {
+		t.Errorf("import changed the dump:\nexported %+v\nimported %+v", dump, copied)
+	}
+	// Secrets stay readable, since the data key moves along.
+	if keys, err := New(target).APIKeys(ctx, "1"); err != nil || !reflect.DeepEqual(keys, []string{"sk-secret"}) {
+		t.Errorf("APIKeys after import = %q, %v", keys, err)
+	}
+}
+
+// sortDump orders the parts of a dump that stores return in no particular order.
+func sortDump(dump *Dump) {
+	sort.Slice(dump.Servers, func(i, j int) bool { return dump.Servers[i].ServerId < dump.Servers[j].ServerId })
+	sort.Slice(dump.AutoModCases, func(i, j int) bool { return dump.AutoModCases[i].Id.Hex() < dump.AutoModCases[j].Id.Hex() })
+	sort.Slice(dump.Usage, func(i, j int) bool {
+		return dump.Usage[i].ServerId+dump.Usage[i].Day < dump.Usage[j].ServerId+dump.Usage[j].Day
+	})
+}
@@ -0,0 +1,203 @@
+package Database
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// errMatchUpsert rejects conditional updates that could create a document.
+var errMatchUpsert = errors.New("a conditional update can't create a document")
+
+// applyUpdate applies an Update to a bson-encoded server document the way MongoDB
+// would, for the stores that don't have MongoDB's update operators. A nil document
+// starts a new one for the server. It returns the new encoding and whether
+// anything changed.
+func applyUpdate(raw []byte, serverId string, update Update) ([]byte, bool, error) {
+	doc := serverDefaults(serverId)
+	if raw != nil {
+		doc = bson.M{}
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return nil, false, fmt.Errorf("corrupt document for server %s: %w", serverId, err)
+		}
+	}
+	if len(update.Match) > 0 {
+		if raw == nil {
+			return nil, false, errMatchUpsert
+		}
+		for path, value := range update.Match {
+			if current, _ := lookup(doc, path).(string); current != value {
+				return raw, false, nil
+			}
+		}
+	}
+
+	// Round-trip the values so they compare equal to what is already stored.
+	normalized := func(values map[string]any) (bson.M, error) {
+		if len(values) == 0 {
+			return bson.M{}, nil
+		}
+		encoded, err := bson.Marshal(bson.M(values))
+		if err != nil {
+			return nil, err
+		}
+		var out bson.M
+		err = bson.Unmarshal(encoded, &out)
+		return out, err
+	}
+
+	changed := raw == nil
+	set, err := normalized(update.Set)
+	if err != nil {
+		return nil, false, err
+	}
+	for path, value := range set {
+		parent, key := walk(doc, path)
+		if !reflect.DeepEqual(parent[key], value) {
+			parent[key] = value
+			changed = true
+		}
+	}
+
+	add, err := normalized(update.AddToSet)
+	if err != nil {
+		return nil, false, err
+	}
+	for path, value := range add {
+		parent, key := walk(doc, path)
+		list, _ := parent[key].(bson.A)
+		if !containsValue(list, value) {
+			parent[key] = append(list, value)
+			changed = true
+		}
+	}
+
+	pull, err := normalized(update.Pull)
+	if err != nil {
+		return nil, false, err
+	}
+	for path, value := range pull {
+		parent, key := walk(doc, path)
+		list, _ := parent[key].(bson.A)
+		kept := bson.A{}
+		for _, item := range list {
+			if !reflect.DeepEqual(item, value) {
+				kept = append(kept, item)
+			}
+		}
+		if len(kept) != len(list) {
+			parent[key] = kept
+			changed = true
+		}
+	}
+
+	for path, delta := range update.Inc {
+		parent, key := walk(doc, path)
+		switch current := parent[key].(type) {
+		case int32:
+			parent[key] = int64(current) + delta
+		case int64:
+			parent[key] = current + delta
+		case float64:
+			parent[key] = current + float64(delta)
+		default:
+			parent[key] = delta
+		}
+		changed = changed || delta != 0
+	}
+
+	encoded, err := bson.Marshal(doc)
+	return encoded, changed, err
+}
+
+// walk returns the sub-document holding the last segment of a dotted path,
+// creating intermediate documents as needed, along with that last segment.
+func walk(doc bson.M, path string) (bson.M, string) {
+	segments := strings.Split(path, ".")
+	for _, segment := range segments[:len(segments)-1] {
+		next, ok := doc[segment].(bson.M)
+		if !ok {
+			next = bson.M{}
+			doc[segment] = next
+		}
+		doc = next
+	}
+	return doc, segments[len(segments)-1]
+}
+
+// lookup returns the value at a dotted path, or nil if it is missing.
+func lookup(doc bson.M, path string) any {
+	segments := strings.Split(path, ".")
+	for _, segment := range segments[:len(segments)-1] {
+		next, ok := doc[segment].(bson.M)
+		if !ok {
+			return nil
+		}
+		doc = next
+	}
+	return doc[segments[len(segments)-1]]
+}
+
+func containsValue(list bson.A, value any) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateTouches reports whether an update writes to field or anything inside or above it.
+func updateTouches(update Update, field string) bool {
+	touches := func(path string) bool {
+		return path == field || strings.HasPrefix(path, field+".") || strings.HasPrefix(field, path+".")
+	}
+	for _, values := range []map[string]any{update.Set, update.AddToSet, update.Pull} {
+		for path := range values {
+			if touches(path) {
+				return true
+			}
+		}
+	}
+	for path := range update.Inc {
+		if touches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeInto copies fields from other into doc: lists are combined without
+// duplicates, sub-documents are merged recursively, and other fields are only
+// taken from other if doc has no value for them.
+func mergeInto(doc bson.M, other bson.M) {
+	for key, value := range other {
+		if key == "_id" {
+			continue
+		}
+		switch v := value.(type) {
+		case bson.A:
+			list, _ := doc[key].(bson.A)
+			for _, item := range v {
+				if !containsValue(list, item) {
+					list = append(list, item)
+				}
+			}
+			doc[key] = list
+		case bson.M:
+			inner, ok := doc[key].(bson.M)
+			if !ok {
+				inner = bson.M{}
+			}
+			mergeInto(inner, v)
+			doc[key] = inner
+		default:
+			if existing, ok := doc[key]; !ok || existing == nil || existing == "" {
+				doc[key] = value
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package Database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestApplyUpdate(t *testing.T) {
+	existing := bson.M{
+		"server_id": "1",
+		"data_key":  "env:v1:old",
+		"apilist":   bson.M{"apikeys": bson.A{"a", "b"}},
+		"moderation": bson.M{
+			"blocked_words": bson.A{"bad"},
+		},
+		"count": int32(2),
+	}
+
+	tests := []struct {
+		name    string
+		doc     bson.M // nil for a missing document
+		update  Update
+		want    map[string]any // dotted paths to expected values
+		changed bool
+		err     error
+	}{
+		{
+			name:    "new document gets defaults",
+			update:  Update{},
+			want:    map[string]any{"server_id": "1", "system_message": "", "apilist.apikeys": bson.A{}, "schema_version": int32(SchemaVersion)},
+			changed: true,
+		},
+		{
+			name:    "set nested field",
+			doc:     existing,
+			update:  Update{Set: map[string]any{"moderation.classifier": true}},
+			want:    map[string]any{"moderation.classifier": true, "moderation.blocked_words": bson.A{"bad"}},
+			changed: true,
+		},
+		{
+			name:   "set to the same value",
+			doc:    existing,
+			update: Update{Set: map[string]any{"data_key": "env:v1:old"}},
+			want:   map[string]any{"data_key": "env:v1:old"},
+		},
+		{
+			name:   "set a list equal to the stored one",
+			doc:    existing,
+			update: Update{Set: map[string]any{"apilist.apikeys": []string{"a", "b"}}},
+			want:   map[string]any{"apilist.apikeys": bson.A{"a", "b"}},
+		},
+		{
+			name:    "add to set",
+			doc:     existing,
+			update:  Update{AddToSet: map[string]any{"apilist.apikeys": "c"}},
+			want:    map[string]any{"apilist.apikeys": bson.A{"a", "b", "c"}},
+			changed: true,
+		},
+		{
+			name:   "add a value already in the set",
+			doc:    existing,
+			update: Update{AddToSet: map[string]any{"apilist.apikeys": "a"}},
+			want:   map[string]any{"apilist.apikeys": bson.A{"a", "b"}},
+		},
+		{
+			name:    "add to a missing list",
+			doc:     existing,
+			update:  Update{AddToSet: map[string]any{"moderation.blocked_patterns": "x+"}},
+			want:    map[string]any{"moderation.blocked_patterns": bson.A{"x+"}},
+			changed: true,
+		},
+		{
+			name:    "pull",
+			doc:     existing,
+			update:  Update{Pull: map[string]any{"apilist.apikeys": "a"}},
+			want:    map[string]any{"apilist.apikeys": bson.A{"b"}},
+			changed: true,
+		},
+		{
+			name:   "pull a missing value",
+			doc:    existing,
+			update: Update{Pull: map[string]any{"moderation.blocked_words": "good"}},
+			want:   map[string]any{"moderation.blocked_words": bson.A{"bad"}},
+		},
+		{
+			name:    "inc an int32",
+			doc:     existing,
+			update:  Update{Inc: map[string]int64{"count": 3}},
+			want:    map[string]any{"count": int64(5)},
+			changed: true,
+		},
+		{
+			name:    "inc a missing field",
+			doc:     existing,
+			update:  Update{Inc: map[string]int64{"stats.replies": 1}},
+			want:    map[string]any{"stats.replies": int64(1)},
+			changed: true,
+		},
+		{
+			name: "match",
+			doc:  existing,
+			update: Update{
+				Set:   map[string]any{"data_key": "env:v2:new"},
+				Match: map[string]string{"data_key": "env:v1:old"},
+			},
+			want:    map[string]any{"data_key": "env:v2:new"},
+			changed: true,
+		},
+		{
+			name: "match fails",
+			doc:  existing,
+			update: Update{
+				Set:   map[string]any{"data_key": "env:v2:new"},
+				Match: map[string]string{"data_key": ""},
+			},
+			want: map[string]any{"data_key": "env:v1:old"},
+		},
+		{
+			name: "match a missing field as empty",
+			doc:  existing,
+			update: Update{
+				Set:   map[string]any{"persona": "pirate"},
+				Match: map[string]string{"persona": ""},
+			},
+			want:    map[string]any{"persona": "pirate"},
+			changed: true,
+		},
+		{
+			name: "match can't create a document",
+			update: Update{
+				Set:   map[string]any{"data_key": "env:v1:new"},
+				Match: map[string]string{"data_key": ""},
+			},
+			err: errMatchUpsert,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw []byte
+			if tt.doc != nil {
+				var err error
+				if raw, err = bson.Marshal(tt.doc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			updated, changed, err := applyUpdate(raw, "1", tt.update)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("applyUpdate returned error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			var doc bson.M
+			if err := bson.Unmarshal(updated, &doc); err != nil {
+				t.Fatal(err)
+			}
+			for path, want := range tt.want {
+				if got := lookup(doc, path); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %#v, want %#v", path, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package Database
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// localLeases keeps leases in process memory. It serves the stores that only
+// one process can open at a time, where there is nobody else to coordinate with.
+type localLeases struct {
+	leasesMu sync.Mutex
+	leases   map[string]lease
+}
+
+type lease struct {
+	owner   string
+	expires time.Time
+}
+
+func (l *localLeases) AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	l.leasesMu.Lock()
+	defer l.leasesMu.Unlock()
+
+	now := time.Now()
+	if current, ok := l.leases[name]; ok && current.owner != owner && current.expires.After(now) {
+		return false, nil
+	}
+	if l.leases == nil {
+		l.leases = map[string]lease{}
+	}
+	l.leases[name] = lease{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (l *localLeases) ReleaseLease(ctx context.Context, name, owner string) error {
+	l.leasesMu.Lock()
+	defer l.leasesMu.Unlock()
+
+	if current, ok := l.leases[name]; ok && current.owner == owner {
+		delete(l.leases, name)
+	}
+	return nil
+}
+
+// AcquireLease claims the named lease for owner, or extends it if owner already
+// holds it. It reports false while another owner holds an unexpired lease.
+func (db *DB) AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	return db.store.AcquireLease(ctx, name, owner, ttl)
+}
+
+// ReleaseLease gives up a lease early so another owner can take it right away.
+func (db *DB) ReleaseLease(ctx context.Context, name, owner string) error {
+	return db.store.ReleaseLease(ctx, name, owner)
+}
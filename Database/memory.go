@@ -0,0 +1,251 @@
+package Database
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore keeps everything in process memory. It is meant for tests and
+// throwaway runs; nothing survives a restart.
+type MemoryStore struct {
+	localLeases
+	mu           sync.Mutex
+	servers      map[string][]byte
+	incidents    []Incident
+	automodCases map[string]AutoModCase
+	auditLog     []AuditEntry
+	usage        map[string]UsageRecord // by usageKey
+}
+
+// NewMemoryStore returns an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		servers:      map[string][]byte{},
+		automodCases: map[string]AutoModCase{},
+		usage:        map[string]UsageRecord{},
+	}
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStore) FindServer(ctx context.Context, serverId string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	raw, ok := m.servers[serverId]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	var result User
+	err := bson.Unmarshal(raw, &result)
+	return result, err
+}
+
+func (m *MemoryStore) UpdateServer(ctx context.Context, serverId string, update Update, upsert bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	raw, ok := m.servers[serverId]
+	if !ok && !upsert {
+		return false, nil
+	}
+	updated, changed, err := applyUpdate(raw, serverId, update)
+	if err != nil {
+		return false, err
+	}
+	m.servers[serverId] = updated
+	return changed, nil
+}
+
+func (m *MemoryStore) InsertIncident(ctx context.Context, incident Incident) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.incidents = append(m.incidents, incident)
+	return nil
+}
+
+func (m *MemoryStore) InsertAutoModCase(ctx context.Context, c AutoModCase) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if c.Id.IsZero() {
+		c.Id = primitive.NewObjectID()
+	}
+	m.automodCases[c.Id.Hex()] = c
+	return c.Id.Hex(), nil
+}
+
+func (m *MemoryStore) FindAutoModCase(ctx context.Context, caseId string) (AutoModCase, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.automodCases[caseId]
+	if !ok {
+		return AutoModCase{}, ErrNotFound
+	}
+	return c, nil
+}
+
+func (m *MemoryStore) UpdateAutoModCase(ctx context.Context, caseId string, expectedStatus string, fields map[string]any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.automodCases[caseId]
+	if !ok || c.Status != expectedStatus {
+		return ErrNotFound
+	}
+	updated, err := setCaseFields(c, fields)
+	if err != nil {
+		return err
+	}
+	m.automodCases[caseId] = updated
+	return nil
+}
+
+func (m *MemoryStore) InsertAuditEntry(ctx context.Context, entry AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.auditLog = append(m.auditLog, entry)
+	return nil
+}
+
+func (m *MemoryStore) FindAuditEntries(ctx context.Context, serverId string, filter AuditFilter) ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []AuditEntry
+	for i := len(m.auditLog) - 1; i >= 0 && len(entries) < filter.limit(); i-- {
+		entry := m.auditLog[i]
+		if entry.ServerId == serverId && filter.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// AddUsage also deletes expired usage, since there is no TTL here.
+func (m *MemoryStore) AddUsage(ctx context.Context, serverId string, day string, usage Usage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := usageCutoff()
+	for key, record := range m.usage {
+		if record.Day < cutoff {
+			delete(m.usage, key)
+		}
+	}
+
+	key := string(usageKey(serverId, day))
+	record, ok := m.usage[key]
+	if !ok {
+		record = UsageRecord{ServerId: serverId, Day: day, ExpiresAt: usageExpiry(day)}
+	}
+	record.Replies += usage.Replies
+	record.PromptTokens += usage.PromptTokens
+	record.OutputTokens += usage.OutputTokens
+	m.usage[key] = record
+	return nil
+}
+
+func (m *MemoryStore) FindUsage(ctx context.Context, serverId string, since string) ([]UsageRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records := []UsageRecord{}
+	for _, record := range m.usage {
+		if record.ServerId == serverId && record.Day >= since {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Day > records[j].Day })
+	return records, nil
+}
+
+// setCaseFields sets top-level fields on a case by their bson names.
+func setCaseFields(c AutoModCase, fields map[string]any) (AutoModCase, error) {
+	raw, err := bson.Marshal(c)
+	if err != nil {
+		return c, err
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return c, err
+	}
+	for key, value := range fields {
+		doc[key] = value
+	}
+	if raw, err = bson.Marshal(doc); err != nil {
+		return c, err
+	}
+	var updated AutoModCase
+	err = bson.Unmarshal(raw, &updated)
+	return updated, err
+}
+
+func (m *MemoryStore) Export(ctx context.Context) (Dump, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var dump Dump
+	for _, raw := range m.servers {
+		var server User
+		if err := bson.Unmarshal(raw, &server); err != nil {
+			return Dump{}, err
+		}
+		dump.Servers = append(dump.Servers, server)
+	}
+	for _, c := range m.automodCases {
+		dump.AutoModCases = append(dump.AutoModCases, c)
+	}
+	dump.Incidents = append(dump.Incidents, m.incidents...)
+	dump.AuditLog = append(dump.AuditLog, m.auditLog...)
+	for _, record := range m.usage {
+		dump.Usage = append(dump.Usage, record)
+	}
+	return dump, nil
+}
+
+func (m *MemoryStore) Migrate(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := newMigrationReport(dryRun)
+	for serverId, raw := range m.servers {
+		var doc bson.M
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+		if !migrateDocument(doc, report) || dryRun {
+			continue
+		}
+		encoded, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		m.servers[serverId] = encoded
+	}
+	return report, nil
+}
+
+func (m *MemoryStore) ServerIDs(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.servers))
+	for serverId := range m.servers {
+		ids = append(ids, serverId)
+	}
+	return ids, nil
+}
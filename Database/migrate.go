@@ -0,0 +1,197 @@
+package Database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Migration upgrades a server document by one schema version. Apply must be
+// idempotent and report whether it changed the document.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(doc bson.M) bool
+}
+
+// migrations are applied in order to every document below their version.
+var migrations = []Migration{
+	{1, "fill in default fields missing from older upserts", fillDefaults},
+	{2, "replace null lists with empty ones", replaceNullLists},
+	{3, "drop usage, which now lives in its own records", dropUsage},
+}
+
+// SchemaVersion is the version new and fully migrated documents are stamped with.
+// It must match the version of the last migration.
+const SchemaVersion = 3
+
+// MigrationReport describes what a migration run changed (or would change, in a dry run).
+type MigrationReport struct {
+	DryRun  bool
+	Scanned int
+	Stamped int
+	Changed map[int]int // documents changed by each migration version
+	Merged  []string    // server IDs whose duplicate documents were merged
+	Moved   int         // servers whose usage moved out of their document
+	Indexes []string
+}
+
+// Migrator is implemented by stores that can upgrade their documents in place.
+type Migrator interface {
+	Migrate(ctx context.Context, dryRun bool) (*MigrationReport, error)
+}
+
+// Migrate runs any pending migrations on a store.
+func Migrate(ctx context.Context, store Store, dryRun bool) (*MigrationReport, error) {
+	migrator, ok := store.(Migrator)
+	if !ok {
+		return nil, fmt.Errorf("this store does not support migrations")
+	}
+	// Usage has to move before the v3 migration drops it from the documents.
+	moved, err := moveUsage(ctx, store, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	report, err := migrator.Migrate(ctx, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	report.Moved = moved
+	return report, nil
+}
+
+// String summarizes the report for logs.
+func (r *MigrationReport) String() string {
+	var b strings.Builder
+	mode := ""
+	if r.DryRun {
+		mode = " (dry run, nothing written)"
+	}
+	fmt.Fprintf(&b, "Schema v%d%s: scanned %d documents, stamped %d.", SchemaVersion, mode, r.Scanned, r.Stamped)
+	for _, m := range migrations {
+		if n := r.Changed[m.Version]; n > 0 {
+			fmt.Fprintf(&b, "\n  v%d %s: %d documents", m.Version, m.Description, n)
+		}
+	}
+	if len(r.Merged) > 0 {
+		fmt.Fprintf(&b, "\n  merged duplicate documents for servers: %s", strings.Join(r.Merged, ", "))
+	}
+	if r.Moved > 0 {
+		fmt.Fprintf(&b, "\n  moved usage out of %d server documents", r.Moved)
+	}
+	if len(r.Indexes) > 0 {
+		fmt.Fprintf(&b, "\n  indexes ensured: %s", strings.Join(r.Indexes, ", "))
+	}
+	return b.String()
+}
+
+func newMigrationReport(dryRun bool) *MigrationReport {
+	return &MigrationReport{DryRun: dryRun, Changed: map[int]int{}}
+}
+
+// migrateDocument applies pending migrations to doc, stamps it with the current
+// schema version and records the result. It reports whether doc needs saving.
+func migrateDocument(doc bson.M, report *MigrationReport) bool {
+	report.Scanned++
+	version := documentVersion(doc)
+	if version >= SchemaVersion {
+		return false
+	}
+	for _, m := range migrations {
+		if m.Version > version && m.Apply(doc) {
+			report.Changed[m.Version]++
+		}
+	}
+	doc["schema_version"] = SchemaVersion
+	report.Stamped++
+	return true
+}
+
+// documentVersion reads schema_version, which may decode as any integer type.
+func documentVersion(doc bson.M) int {
+	switch v := doc["schema_version"].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+// serverDefaults are the fields every server document starts with.
+func serverDefaults(serverId string) bson.M {
+	return bson.M{
+		"server_id":        serverId,
+		"server_data":      "",
+		"activate_channel": "",
+		"system_message":   "",
+		"apilist":          bson.M{"apikeys": bson.A{}},
+		"schema_version":   SchemaVersion,
+	}
+}
+
+func fillDefaults(doc bson.M) bool {
+	changed := false
+	serverId, _ := doc["server_id"].(string)
+	for key, value := range serverDefaults(serverId) {
+		if key == "schema_version" {
+			continue
+		}
+		if _, ok := doc[key]; !ok {
+			doc[key] = value
+			changed = true
+		}
+	}
+	return changed
+}
+
+// listFields are the array fields commands add to with $addToSet, which fails
+// in MongoDB if the field holds null.
+var listFields = []string{
+	"apilist.apikeys",
+	"moderation.blocked_words",
+	"moderation.blocked_patterns",
+	"automod.channels",
+	"access.allow_roles",
+	"access.allow_users",
+	"access.deny_roles",
+	"access.deny_users",
+}
+
+func replaceNullLists(doc bson.M) bool {
+	changed := false
+	for _, path := range listFields {
+		segments := strings.Split(path, ".")
+		parent := doc
+		for _, segment := range segments[:len(segments)-1] {
+			next, ok := parent[segment].(bson.M)
+			if !ok {
+				parent = nil
+				break
+			}
+			parent = next
+		}
+		if parent == nil {
+			continue
+		}
+		last := segments[len(segments)-1]
+		if value, ok := parent[last]; ok && value == nil {
+			parent[last] = bson.A{}
+			changed = true
+		}
+	}
+	return changed
+}
+
+func dropUsage(doc bson.M) bool {
+	if _, ok := doc["usage"]; !ok {
+		return false
+	}
+	delete(doc, "usage")
+	return true
+}
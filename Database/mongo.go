@@ -0,0 +1,536 @@
+package Database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hellish/Metrics"
+	"hellish/Tracing"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MongoStore keeps everything in the "Hellish" MongoDB database.
+type MongoStore struct {
+	client       *mongo.Client
+	collection   *mongo.Collection
+	incidents    *mongo.Collection
+	automodCases *mongo.Collection
+	auditLog     *mongo.Collection
+	usage        *mongo.Collection
+	leases       *mongo.Collection
+}
+
+// NewMongoStore connects to MongoDB and verifies the connection.
+func NewMongoStore(mongoURL string) (*MongoStore, error) {
+	if mongoURL == "" {
+		return nil, fmt.Errorf("MONGO_URL environment variable not set")
+	}
+	clientOptions := options.Client().ApplyURI(mongoURL).SetMonitor(commandMetrics)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to MongoDB: %w", err)
+	}
+
+	if err := client.Ping(ctx, nil); err != nil {
+		return nil, fmt.Errorf("could not ping MongoDB: %w", err)
+	}
+
+	db := client.Database("Hellish")
+	slog.Info("Connected to MongoDB")
+	return &MongoStore{
+		client:       client,
+		collection:   db.Collection("users"),
+		incidents:    db.Collection("incidents"),
+		automodCases: db.Collection("automod_cases"),
+		auditLog:     db.Collection("audit_log"),
+		usage:        db.Collection("usage"),
+		leases:       db.Collection("leases"),
+	}, nil
+}
+
+// commandSpans holds the span of each MongoDB command in flight, by request ID.
+var commandSpans sync.Map
+
+// commandMetrics records the latency and failures of every MongoDB command,
+// and traces it as part of the operation that ran it.
+var commandMetrics = &event.CommandMonitor{
+	Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		_, span := Tracing.Start(ctx, "mongo."+e.CommandName,
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.operation.name", e.CommandName),
+			attribute.String("db.namespace", e.DatabaseName),
+		)
+		commandSpans.Store(e.RequestID, span)
+	},
+	Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+		Metrics.DatabaseDuration.Observe(e.Duration.Seconds(), e.CommandName)
+		endCommandSpan(e.RequestID, nil)
+	},
+	Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+		Metrics.DatabaseDuration.Observe(e.Duration.Seconds(), e.CommandName)
+		Metrics.DatabaseErrors.Inc(e.CommandName)
+		endCommandSpan(e.RequestID, errors.New(e.Failure))
+	},
+}
+
+func endCommandSpan(requestID int64, err error) {
+	if span, ok := commandSpans.LoadAndDelete(requestID); ok {
+		Tracing.End(span.(trace.Span), err)
+	}
+}
+
+// Close should be called when your application is shutting down.
+func (m *MongoStore) Close() error {
+	slog.Info("Disconnecting from MongoDB")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return m.client.Disconnect(ctx)
+}
+
+func (m *MongoStore) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return m.client.Ping(ctx, nil)
+}
+
+func (m *MongoStore) FindServer(ctx context.Context, serverId string) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var result User
+	err := m.collection.FindOne(ctx, bson.M{"server_id": serverId}).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return User{}, ErrNotFound
+	}
+	return result, err
+}
+
+func (m *MongoStore) UpdateServer(ctx context.Context, serverId string, update Update, upsert bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	doc := bson.M{}
+	if len(update.Set) > 0 {
+		doc["$set"] = bson.M(update.Set)
+	}
+	if len(update.AddToSet) > 0 {
+		doc["$addToSet"] = bson.M(update.AddToSet)
+	}
+	if len(update.Pull) > 0 {
+		doc["$pull"] = bson.M(update.Pull)
+	}
+	if len(update.Inc) > 0 {
+		inc := bson.M{}
+		for path, delta := range update.Inc {
+			inc[path] = delta
+		}
+		doc["$inc"] = inc
+	}
+	if upsert {
+		// New documents get the same defaults as in every other store, except for
+		// fields this update writes, which MongoDB won't let both operators touch.
+		onInsert := bson.M{}
+		for key, value := range serverDefaults(serverId) {
+			if !updateTouches(update, key) {
+				onInsert[key] = value
+			}
+		}
+		doc["$setOnInsert"] = onInsert
+	}
+	filter := bson.M{"server_id": serverId}
+	if len(update.Match) > 0 {
+		if upsert {
+			return false, errMatchUpsert
+		}
+		for path, value := range update.Match {
+			if value == "" {
+				// Matches missing and null fields too.
+				filter[path] = bson.M{"$in": bson.A{nil, ""}}
+			} else {
+				filter[path] = value
+			}
+		}
+	}
+	opts := options.Update().SetUpsert(upsert)
+
+	res, err := m.collection.UpdateOne(ctx, filter, doc, opts)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0 || res.UpsertedCount > 0, nil
+}
+
+func (m *MongoStore) InsertIncident(ctx context.Context, incident Incident) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.incidents.InsertOne(ctx, incident)
+	return err
+}
+
+func (m *MongoStore) InsertAutoModCase(ctx context.Context, c AutoModCase) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := m.automodCases.InsertOne(ctx, c); err != nil {
+		return "", err
+	}
+	return c.Id.Hex(), nil
+}
+
+func (m *MongoStore) FindAutoModCase(ctx context.Context, caseId string) (AutoModCase, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	id, err := primitive.ObjectIDFromHex(caseId)
+	if err != nil {
+		return AutoModCase{}, ErrNotFound
+	}
+
+	var result AutoModCase
+	err = m.automodCases.FindOne(ctx, bson.M{"_id": id}).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return AutoModCase{}, ErrNotFound
+	}
+	return result, err
+}
+
+func (m *MongoStore) UpdateAutoModCase(ctx context.Context, caseId string, expectedStatus string, fields map[string]any) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	id, err := primitive.ObjectIDFromHex(caseId)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	res, err := m.automodCases.UpdateOne(ctx, bson.M{"_id": id, "status": expectedStatus}, bson.M{"$set": bson.M(fields)})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoStore) InsertAuditEntry(ctx context.Context, entry AuditEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.auditLog.InsertOne(ctx, entry)
+	return err
+}
+
+func (m *MongoStore) FindAuditEntries(ctx context.Context, serverId string, filter AuditFilter) ([]AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := bson.M{"server_id": serverId}
+	if filter.ActorId != "" {
+		query["actor_id"] = filter.ActorId
+	}
+	if filter.Action != "" {
+		query["action"] = bson.M{"$regex": "^" + regexp.QuoteMeta(filter.Action)}
+	}
+	if filter.Field != "" {
+		query["changes.field"] = bson.M{"$regex": "^" + regexp.QuoteMeta(filter.Field)}
+	}
+	opts := options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(int64(filter.limit()))
+
+	cursor, err := m.auditLog.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	var entries []AuditEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (m *MongoStore) AddUsage(ctx context.Context, serverId string, day string, usage Usage) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$inc": bson.M{
+			"replies":       usage.Replies,
+			"prompt_tokens": usage.PromptTokens,
+			"output_tokens": usage.OutputTokens,
+		},
+		"$setOnInsert": bson.M{"expires_at": usageExpiry(day)},
+	}
+	filter := bson.M{"server_id": serverId, "day": day}
+	_, err := m.usage.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (m *MongoStore) FindUsage(ctx context.Context, serverId string, since string) ([]UsageRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := bson.M{"server_id": serverId, "day": bson.M{"$gte": since}}
+	cursor, err := m.usage.Find(ctx, query, options.Find().SetSort(bson.M{"day": -1}))
+	if err != nil {
+		return nil, err
+	}
+	records := []UsageRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (m *MongoStore) Export(ctx context.Context) (Dump, error) {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	var dump Dump
+	if err := exportCollection(ctx, m.collection, &dump.Servers); err != nil {
+		return Dump{}, err
+	}
+	if err := exportCollection(ctx, m.incidents, &dump.Incidents); err != nil {
+		return Dump{}, err
+	}
+	if err := exportCollection(ctx, m.automodCases, &dump.AutoModCases); err != nil {
+		return Dump{}, err
+	}
+	if err := exportCollection(ctx, m.auditLog, &dump.AuditLog); err != nil {
+		return Dump{}, err
+	}
+	if err := exportCollection(ctx, m.usage, &dump.Usage); err != nil {
+		return Dump{}, err
+	}
+	return dump, nil
+}
+
+// exportCollection decodes every document in a collection into out.
+func exportCollection[T any](ctx context.Context, collection *mongo.Collection, out *[]T) error {
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", collection.Name(), err)
+	}
+	return cursor.All(ctx, out)
+}
+
+// WatchServers follows a change stream on the server collection. Change streams
+// need a replica set; on a standalone server this returns an error right away.
+func (m *MongoStore) WatchServers(ctx context.Context, onChange func(serverId string)) error {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	stream, err := m.collection.Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var event struct {
+			FullDocument *User `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil || event.FullDocument == nil {
+			// Deletes carry no document, so we can't tell which server it was.
+			onChange("")
+			continue
+		}
+		onChange(event.FullDocument.ServerId)
+	}
+	return stream.Err()
+}
+
+// Migrate merges duplicate server documents, upgrades every document below
+// SchemaVersion and ensures the indexes the queries rely on.
+func (m *MongoStore) Migrate(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	report := newMigrationReport(dryRun)
+
+	// The unique index below can't be built while duplicates exist, which racing
+	// upserts could create before it was there.
+	merged, err := m.mergeDuplicates(ctx, dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge duplicate servers: %w", err)
+	}
+	report.Merged = merged
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"schema_version": bson.M{"$exists": false}},
+		bson.M{"schema_version": bson.M{"$lt": SchemaVersion}},
+	}}
+	cursor, err := m.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan servers: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to decode server document: %w", err)
+		}
+		id, previous := doc["_id"], doc["schema_version"]
+		if !migrateDocument(doc, report) || dryRun {
+			continue
+		}
+		// Only replace the document if nobody migrated it in the meantime.
+		match := bson.M{"_id": id, "schema_version": previous}
+		if previous == nil {
+			match["schema_version"] = bson.M{"$exists": false}
+		}
+		if _, err := m.collection.ReplaceOne(ctx, match, doc); err != nil {
+			return nil, fmt.Errorf("failed to save migrated server %v: %w", doc["server_id"], err)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	indexes := map[*mongo.Collection][]mongo.IndexModel{
+		m.collection: {{Keys: bson.D{{Key: "server_id", Value: 1}}, Options: options.Index().SetUnique(true)}},
+		m.incidents:  {{Keys: bson.D{{Key: "server_id", Value: 1}, {Key: "created_at", Value: -1}}}},
+		m.automodCases: {
+			{Keys: bson.D{{Key: "server_id", Value: 1}, {Key: "status", Value: 1}}},
+		},
+		m.auditLog: {
+			{Keys: bson.D{{Key: "server_id", Value: 1}, {Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "server_id", Value: 1}, {Key: "actor_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		},
+		// Usage is counted per server and day, and dropped once it expires.
+		m.usage: {
+			{Keys: bson.D{{Key: "server_id", Value: 1}, {Key: "day", Value: -1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		// Expired leases are only kept around for an hour, for debugging.
+		m.leases: {{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(3600)}},
+	}
+	for collection, models := range indexes {
+		names, err := collection.Indexes().CreateMany(ctx, models)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create indexes on %s: %w", collection.Name(), err)
+		}
+		for _, name := range names {
+			report.Indexes = append(report.Indexes, collection.Name()+"."+name)
+		}
+	}
+	return report, nil
+}
+
+// mergeDuplicates folds every group of documents sharing a server_id into the
+// oldest one. Lists are combined; other fields keep the oldest non-empty value.
+func (m *MongoStore) mergeDuplicates(ctx context.Context, dryRun bool) ([]string, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$server_id", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}
+	cursor, err := m.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		ServerId string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	var merged []string
+	for _, group := range groups {
+		merged = append(merged, group.ServerId)
+		if dryRun {
+			continue
+		}
+
+		cursor, err := m.collection.Find(ctx, bson.M{"server_id": group.ServerId}, options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return nil, err
+		}
+		var docs []bson.M
+		if err := cursor.All(ctx, &docs); err != nil {
+			return nil, err
+		}
+
+		keep := docs[0]
+		var drop bson.A
+		for _, doc := range docs[1:] {
+			mergeInto(keep, doc)
+			drop = append(drop, doc["_id"])
+		}
+		if _, err := m.collection.ReplaceOne(ctx, bson.M{"_id": keep["_id"]}, keep); err != nil {
+			return nil, err
+		}
+		if _, err := m.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": drop}}); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+func (m *MongoStore) ServerIDs(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	values, err := m.collection.Distinct(ctx, "server_id", bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(values))
+	for _, value := range values {
+		if id, ok := value.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// AcquireLease takes the lease if it is free, expired or already owner's. The
+// expiry is computed on the server so processes don't depend on their clocks
+// agreeing. If someone else holds it the filter misses, and the upsert then
+// collides with their document's _id.
+func (m *MongoStore) AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": name, "$or": bson.A{
+		bson.M{"owner": owner},
+		bson.M{"$expr": bson.M{"$lt": bson.A{"$expires_at", "$$NOW"}}},
+	}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"owner":      owner,
+		"expires_at": bson.M{"$add": bson.A{"$$NOW", ttl.Milliseconds()}},
+	}}}}
+	_, err := m.leases.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *MongoStore) ReleaseLease(ctx context.Context, name, owner string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.leases.DeleteOne(ctx, bson.M{"_id": name, "owner": owner})
+	return err
+}
@@ -0,0 +1,83 @@
+package Database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Open returns the store described by spec:
+//
+//	mongodb://... or mongodb+srv://...   MongoDB at that URL
+//	bolt://path/to/file.db               a local bbolt file
+//	memory://                            process memory, lost on exit
+//
+// An empty spec falls back to MongoDB at mongoURL, so existing deployments
+// that only set MONGO_URL keep working.
+func Open(spec string, mongoURL string) (Store, error) {
+	switch {
+	case spec == "":
+		return NewMongoStore(mongoURL)
+	case strings.HasPrefix(spec, "mongodb://"), strings.HasPrefix(spec, "mongodb+srv://"):
+		return NewMongoStore(spec)
+	case strings.HasPrefix(spec, "bolt://"):
+		path := strings.TrimPrefix(spec, "bolt://")
+		if path == "" {
+			return nil, fmt.Errorf("STORE=bolt:// needs a file path, e.g. bolt://hellish.db")
+		}
+		return NewBoltStore(path)
+	case strings.HasPrefix(spec, "memory://"):
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unsupported STORE %q, expected mongodb://, bolt:// or memory://", spec)
+	}
+}
+
+// Import copies a dump into a store. Servers that already exist have their
+// fields overwritten by the dump; records are appended and usage is added to.
+func Import(ctx context.Context, store Store, dump Dump) error {
+	for _, server := range dump.Servers {
+		raw, err := bson.Marshal(server)
+		if err != nil {
+			return err
+		}
+		var fields bson.M
+		if err := bson.Unmarshal(raw, &fields); err != nil {
+			return err
+		}
+		delete(fields, "_id")
+		// Dumps from older versions carry usage in the server documents.
+		delete(fields, "usage")
+		for day, usage := range server.LegacyUsage {
+			if err := store.AddUsage(ctx, server.ServerId, day, usage); err != nil {
+				return fmt.Errorf("failed to import usage of server %s: %w", server.ServerId, err)
+			}
+		}
+		if _, err := store.UpdateServer(ctx, server.ServerId, Update{Set: fields}, true); err != nil {
+			return fmt.Errorf("failed to import server %s: %w", server.ServerId, err)
+		}
+	}
+	for _, incident := range dump.Incidents {
+		if err := store.InsertIncident(ctx, incident); err != nil {
+			return fmt.Errorf("failed to import incident: %w", err)
+		}
+	}
+	for _, c := range dump.AutoModCases {
+		if _, err := store.InsertAutoModCase(ctx, c); err != nil {
+			return fmt.Errorf("failed to import auto-mod case %s: %w", c.Id.Hex(), err)
+		}
+	}
+	for _, entry := range dump.AuditLog {
+		if err := store.InsertAuditEntry(ctx, entry); err != nil {
+			return fmt.Errorf("failed to import audit entry: %w", err)
+		}
+	}
+	for _, record := range dump.Usage {
+		if err := store.AddUsage(ctx, record.ServerId, record.Day, record.Usage); err != nil {
+			return fmt.Errorf("failed to import usage of server %s: %w", record.ServerId, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package Database
+
+import (
+	"context"
+	"fmt"
+	"hellish/crypto"
+)
+
+// RotationReport counts what RotateKeys did.
+type RotationReport struct {
+	Servers int
+	// Created and Rewrapped count data keys made or rewrapped with the active master key.
+	Created   int
+	Rewrapped int
+	// Bound counts API keys re-sealed with the data key and bound to their
+	// server, from master-key encryption or unbound data key sealing.
+	Bound int
+	// Failed lists secrets no configured key could decrypt, by server.
+	Failed map[string]int
+	// Misplaced lists bound secrets that belong to another server or field,
+	// which means the database was edited.
+	Misplaced map[string]int
+}
+
+func (r *RotationReport) String() string {
+	s := fmt.Sprintf("Checked %d servers against %s: %d data keys created, %d rewrapped, %d API keys re-sealed and bound to their server.",
+		r.Servers, crypto.Describe(), r.Created, r.Rewrapped, r.Bound)
+	for serverId, n := range r.Failed {
+		s += fmt.Sprintf("\n  server %s: %d secrets could not be decrypted with any configured key", serverId, n)
+	}
+	for serverId, n := range r.Misplaced {
+		s += fmt.Sprintf("\n  server %s: %d secrets were copied from another server or modified, remove them", serverId, n)
+	}
+	return s
+}
+
+// RotateKeys makes sure every server's data key is wrapped by the active master
+// key and that its API keys are sealed with that data key and bound to the
+// server. Rewrapping leaves the data key itself unchanged, so sealed secrets
+// need no re-encryption. progress is called after each server. Secrets that
+// can't be decrypted or belong elsewhere are left untouched and reported.
+func RotateKeys(ctx context.Context, store Store, progress func(done, total int, serverId string, changed int)) (*RotationReport, error) {
+	serverIds, err := store.ServerIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers: %w", err)
+	}
+
+	report := &RotationReport{Servers: len(serverIds), Failed: map[string]int{}, Misplaced: map[string]int{}}
+	for i, serverId := range serverIds {
+		changed, err := rotateServer(ctx, store, serverId, report)
+		if err != nil {
+			return report, fmt.Errorf("server %s: %w", serverId, err)
+		}
+		if progress != nil {
+			progress(i+1, len(serverIds), serverId, changed)
+		}
+	}
+	return report, nil
+}
+
+func rotateServer(ctx context.Context, store Store, serverId string, report *RotationReport) (int, error) {
+	server, err := store.FindServer(ctx, serverId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load: %w", err)
+	}
+
+	changed := 0
+	var dataKey []byte
+	switch {
+	case server.DataKey == "" && len(server.ApiList.Apikeys) == 0:
+		// Nothing to protect; a data key is created with the first API key.
+		return 0, nil
+	case server.DataKey == "":
+		var wrapped string
+		if dataKey, wrapped, err = crypto.NewDataKey(ctx); err != nil {
+			return 0, err
+		}
+		stored, err := storeDataKey(ctx, store, serverId, "", wrapped)
+		if err != nil {
+			return 0, err
+		}
+		if !stored {
+			// The bot stored one meanwhile; start over with that one.
+			return rotateServer(ctx, store, serverId, report)
+		}
+		report.Created++
+		changed++
+	default:
+		if dataKey, err = crypto.UnwrapDataKey(ctx, server.DataKey); err != nil {
+			report.Failed[serverId]++
+			return 0, nil
+		}
+		needsRewrap, err := crypto.NeedsRewrap(ctx, server.DataKey)
+		if err != nil {
+			return 0, err
+		}
+		if needsRewrap {
+			wrapped, err := crypto.RewrapDataKey(ctx, server.DataKey)
+			if err != nil {
+				return 0, err
+			}
+			stored, err := storeDataKey(ctx, store, serverId, server.DataKey, wrapped)
+			if err != nil {
+				return 0, err
+			}
+			if !stored {
+				return rotateServer(ctx, store, serverId, report)
+			}
+			report.Rewrapped++
+			changed++
+		}
+	}
+
+	for _, key := range server.ApiList.Apikeys {
+		if crypto.IsBound(key) {
+			if _, err := crypto.Open(dataKey, key, serverId, apiKeysField); err != nil {
+				report.Misplaced[serverId]++
+			}
+			continue
+		}
+		plaintext, err := crypto.Open(dataKey, key, serverId, apiKeysField)
+		if err != nil {
+			report.Failed[serverId]++
+			continue
+		}
+		sealed, err := crypto.Seal(dataKey, plaintext, serverId, apiKeysField)
+		if err != nil {
+			return changed, err
+		}
+
+		// Add before removing so the server never runs without the key, and
+		// touch only this entry so keys added meanwhile aren't lost.
+		add := Update{AddToSet: map[string]any{apiKeysField: sealed}}
+		if _, err := store.UpdateServer(ctx, serverId, add, false); err != nil {
+			return changed, fmt.Errorf("failed to save re-encrypted key: %w", err)
+		}
+		pull := Update{Pull: map[string]any{apiKeysField: key}}
+		if _, err := store.UpdateServer(ctx, serverId, pull, false); err != nil {
+			return changed, fmt.Errorf("failed to remove old key: %w", err)
+		}
+		report.Bound++
+		changed++
+	}
+	return changed, nil
+}
@@ -0,0 +1,103 @@
+package Database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UsageRetention is how long a day's usage is kept. Older records expire,
+// through a TTL index in MongoDB and when a server records usage elsewhere.
+const UsageRetention = 90 * 24 * time.Hour
+
+// Usage is how much a server used the AI on one day.
+type Usage struct {
+	Replies      int64 `bson:"replies" json:"replies"`
+	PromptTokens int64 `bson:"prompt_tokens" json:"prompt_tokens"`
+	OutputTokens int64 `bson:"output_tokens" json:"output_tokens"`
+}
+
+// UsageRecord is one server's usage on one UTC day. Usage is kept out of the
+// server document so that recording it, after every reply, doesn't invalidate
+// the cached guild config.
+type UsageRecord struct {
+	ServerId  string `bson:"server_id" json:"server_id"`
+	Day       string `bson:"day" json:"day"` // like "2006-01-02"
+	Usage     `bson:",inline"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// usageExpiry returns when the usage of a "2006-01-02" day expires.
+func usageExpiry(day string) time.Time {
+	start, err := time.Parse(time.DateOnly, day)
+	if err != nil {
+		start = time.Now().UTC()
+	}
+	return start.Add(UsageRetention)
+}
+
+// usageCutoff is the oldest day whose usage hasn't expired yet.
+func usageCutoff() string {
+	return time.Now().UTC().Add(-UsageRetention).Format(time.DateOnly)
+}
+
+// RecordUsage adds one reply and its token counts to today's usage.
+func (db *DB) RecordUsage(ctx context.Context, serverId string, promptTokens, outputTokens int64) error {
+	day := time.Now().UTC().Format(time.DateOnly)
+	usage := Usage{Replies: 1, PromptTokens: promptTokens, OutputTokens: outputTokens}
+	if err := db.store.AddUsage(ctx, serverId, day, usage); err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	return nil
+}
+
+// RecentUsage returns a server's usage over the last days days, newest first.
+func (db *DB) RecentUsage(ctx context.Context, serverId string, days int) ([]UsageRecord, error) {
+	since := time.Now().UTC().AddDate(0, 0, -days).Format(time.DateOnly)
+	records, err := db.store.FindUsage(ctx, serverId, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load usage: %w", err)
+	}
+	return records, nil
+}
+
+// moveUsage moves usage that older versions kept in the server documents into
+// the usage records. Each server's old usage is cleared right after it moves,
+// so running this again doesn't count it twice. The usage field itself is
+// removed by the schema v3 migration.
+func moveUsage(ctx context.Context, store Store, dryRun bool) (int, error) {
+	ids, err := store.ServerIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, serverId := range ids {
+		server, err := store.FindServer(ctx, serverId)
+		if err != nil {
+			return moved, fmt.Errorf("failed to read server %s: %w", serverId, err)
+		}
+		if len(server.LegacyUsage) == 0 {
+			continue
+		}
+		moved++
+		if dryRun {
+			continue
+		}
+		for day, usage := range server.LegacyUsage {
+			if day < usageCutoff() {
+				continue
+			}
+			if err := store.AddUsage(ctx, serverId, day, usage); err != nil {
+				return moved, fmt.Errorf("failed to move usage of server %s: %w", serverId, err)
+			}
+		}
+		if _, err := store.UpdateServer(ctx, serverId, Update{Set: map[string]any{"usage": bson.M{}}}, false); err != nil {
+			return moved, fmt.Errorf("failed to clear old usage of server %s: %w", serverId, err)
+		}
+		slog.Debug("Moved usage out of the server document", "guild", serverId, "days", len(server.LegacyUsage))
+	}
+	return moved, nil
+}
@@ -0,0 +1,220 @@
+package Discord
+
+import (
+	"context"
+	"fmt"
+	"hellish/Audit"
+	"hellish/Database"
+	"hellish/Permissions"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// noticeLifetime is how long an access notice stays up before it is deleted.
+	noticeLifetime = 10 * time.Second
+	// noticeCooldown keeps a blocked user from getting a notice for every message.
+	noticeCooldown = 5 * time.Minute
+)
+
+var (
+	// lastNotice maps "channelID:userID" to the time the user was last sent a notice.
+	lastNotice sync.Map
+	// noticesPruned is when expired entries were last removed from lastNotice.
+	noticesPrunedMu sync.Mutex
+	noticesPruned   time.Time
+)
+
+// pruneNotices forgets notices older than the cooldown, at most once per
+// cooldown, so lastNotice doesn't keep every user that was ever refused.
+func pruneNotices(now time.Time) {
+	noticesPrunedMu.Lock()
+	if now.Sub(noticesPruned) < noticeCooldown {
+		noticesPrunedMu.Unlock()
+		return
+	}
+	noticesPruned = now
+	noticesPrunedMu.Unlock()
+
+	lastNotice.Range(func(key, last any) bool {
+		if now.Sub(last.(time.Time)) >= noticeCooldown {
+			// Leave entries that were renewed meanwhile.
+			lastNotice.CompareAndDelete(key, last)
+		}
+		return true
+	})
+}
+
+// canChat reports whether the author of a message may chat with the AI, checking
+// the chat capability and the access lists. If the server has notices turned on,
+// refused users get a short-lived reply explaining why they were ignored.
+func (b *Bot) canChat(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	perms, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		slog.Error("Error getting user permissions", "user", m.Author.ID, "err", err)
+		return false
+	}
+	config, err := b.db.ViewServer(ctx, m.GuildID)
+	if err != nil {
+		slog.Error("Error loading config", "guild", m.GuildID, "err", err)
+		return false
+	}
+
+	var roles []string
+	if m.Member != nil {
+		roles = m.Member.Roles
+	}
+
+	allowed, reason := Permissions.CanChat(config.Access, config.ChannelAccess[m.ChannelID], m.Author.ID, roles, perms)
+	if allowed && !Permissions.Allowed(config.Permissions, Permissions.Chat, m.Author.ID, roles, perms) {
+		allowed, reason = false, "you don't have permission to chat with me"
+	}
+	if !allowed && config.AccessNotice {
+		sendAccessNotice(s, m, reason)
+	}
+	return allowed
+}
+
+// sendAccessNotice replies with a notice that deletes itself, standing in for an
+// ephemeral message since those only exist for interactions.
+func sendAccessNotice(s *discordgo.Session, m *discordgo.MessageCreate, reason string) {
+	key := m.ChannelID + ":" + m.Author.ID
+	if last, ok := lastNotice.Load(key); ok && time.Since(last.(time.Time)) < noticeCooldown {
+		return
+	}
+	pruneNotices(time.Now())
+	lastNotice.Store(key, time.Now())
+
+	notice, err := s.ChannelMessageSendReply(m.ChannelID, fmt.Sprintf("🚫 sorry, %s.", reason), m.Reference())
+	if err != nil {
+		slog.Error("Error sending access notice", "guild", m.GuildID, "err", err)
+		return
+	}
+	time.AfterFunc(noticeLifetime, func() {
+		s.ChannelMessageDelete(notice.ChannelID, notice.ID)
+	})
+}
+
+func (b *Bot) handleAccess(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author.ID == s.State.User.ID {
+		return
+	}
+
+	// We only care about messages starting with "!access"
+	if !strings.HasPrefix(m.Content, prefix+"access") {
+		return
+	}
+
+	usage := "Usage: `!access view`, `!access notice <on|off>` or `!access <server|channel> <allow|deny> <add|remove> <@role|@user>`"
+	parts := strings.Fields(m.Content)
+	if len(parts) < 2 {
+		s.ChannelMessageSend(m.ChannelID, usage)
+		return
+	}
+
+	subcommand := parts[1]
+
+	if subcommand != "view" && !b.requireCapability(ctx, s, m, Permissions.ManageAccess, "change who may chat with me") {
+		return
+	}
+
+	switch subcommand {
+	case "view":
+		config, err := b.db.ViewServer(ctx, m.GuildID)
+		if err != nil {
+			b.reportError(s, m, "viewing access lists", err)
+			return
+		}
+		notice := "Off"
+		if config.AccessNotice {
+			notice = "On"
+		}
+		embed := &discordgo.MessageEmbed{
+			Title:       "🚪 Chat Access",
+			Description: "Deny entries always win. A channel allow list replaces the server one in that channel.",
+			Color:       0x5865F2,
+			Fields: []*discordgo.MessageEmbedField{
+				{Name: "Server", Value: describeAccess(config.Access)},
+				{Name: "This Channel", Value: describeAccess(config.ChannelAccess[m.ChannelID])},
+				{Name: "Notices", Value: notice},
+			},
+		}
+		s.ChannelMessageSendEmbed(m.ChannelID, embed)
+
+	case "notice":
+		if len(parts) < 3 || (parts[2] != "on" && parts[2] != "off") {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!access notice <on|off>`")
+			return
+		}
+		before := Audit.Take(ctx, b.db, m.GuildID)
+		if err := b.db.SetAccessNotice(ctx, m.GuildID, parts[2] == "on"); err != nil {
+			b.reportError(s, m, "setting access notice", err)
+			return
+		}
+		b.auditChange(ctx, m.GuildID, m.Author, "access.notice", before)
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ Access notices are now %s.", parts[2]))
+
+	case "server", "channel":
+		if len(parts) < 5 || (parts[2] != "allow" && parts[2] != "deny") || (parts[3] != "add" && parts[3] != "remove") {
+			s.ChannelMessageSend(m.ChannelID, usage)
+			return
+		}
+		kind, id, ok := parseMention(parts[4])
+		if !ok {
+			s.ChannelMessageSend(m.ChannelID, "Please mention a role or a user.")
+			return
+		}
+
+		channelID := ""
+		if subcommand == "channel" {
+			channelID = m.ChannelID
+		}
+		list := parts[2] + "_" + kind // e.g. "allow_roles"
+
+		before := Audit.Take(ctx, b.db, m.GuildID)
+		var err error
+		if parts[3] == "add" {
+			err = b.db.AddAccessEntry(ctx, m.GuildID, channelID, list, id)
+		} else {
+			err = b.db.RemoveAccessEntry(ctx, m.GuildID, channelID, list, id)
+		}
+		if err != nil {
+			b.reportError(s, m, "updating access list", err)
+			return
+		}
+		b.auditChange(ctx, m.GuildID, m.Author, "access."+subcommand+"."+parts[2]+"."+parts[3], before)
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ The %s %s list has been updated.", subcommand, parts[2]))
+
+	default:
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unknown subcommand `%s`. %s", subcommand, usage))
+	}
+}
+
+func describeAccess(list Database.AccessList) string {
+	var lines []string
+	add := func(label string, mentions []string) {
+		if len(mentions) > 0 {
+			lines = append(lines, fmt.Sprintf("**%s:** %s", label, strings.Join(mentions, ", ")))
+		}
+	}
+	add("Allowed roles", wrapIDs(list.AllowRoles, "<@&"))
+	add("Allowed users", wrapIDs(list.AllowUsers, "<@"))
+	add("Denied roles", wrapIDs(list.DenyRoles, "<@&"))
+	add("Denied users", wrapIDs(list.DenyUsers, "<@"))
+	if len(lines) == 0 {
+		return "Everyone may chat."
+	}
+	return strings.Join(lines, "\n")
+}
+
+func wrapIDs(ids []string, open string) []string {
+	mentions := make([]string, len(ids))
+	for i, id := range ids {
+		mentions[i] = open + id + ">"
+	}
+	return mentions
+}
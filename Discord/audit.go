@@ -0,0 +1,197 @@
+package Discord
+
+import (
+	"context"
+	"fmt"
+	"hellish/Audit"
+	"hellish/Database"
+	"hellish/Permissions"
+	"log/slog"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// auditChange records what changed since the snapshot was taken. The entry is
+// mirrored to the server's audit channel through the mirror set by MirrorAudit.
+func (b *Bot) auditChange(ctx context.Context, guildID string, actor *discordgo.User, action string, before Audit.Snapshot) {
+	if _, err := Audit.Record(ctx, b.db, guildID, actor.ID, actor.Username, action, before); err != nil {
+		slog.Error("Error recording audit entry", "guild", guildID, "err", err)
+	}
+}
+
+// MirrorAudit posts every audit entry in its server's audit channel, if one is
+// set, whether the change was made in Discord, on the dashboard or on the
+// command line. It only uses Discord's REST API, so it works without a
+// gateway connection.
+func MirrorAudit(db *Database.DB, token string) error {
+	sess, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return fmt.Errorf("failed to create Discord session: %w", err)
+	}
+	Audit.SetMirror(func(ctx context.Context, entry *Database.AuditEntry) {
+		config, err := db.ViewServer(ctx, entry.ServerId)
+		if err != nil || config.AuditChannel == "" {
+			return
+		}
+		if _, err := sess.ChannelMessageSendEmbed(config.AuditChannel, auditEmbed(entry), discordgo.WithContext(ctx)); err != nil {
+			slog.Error("Error mirroring audit entry", "guild", entry.ServerId, "channel", config.AuditChannel, "err", err)
+		}
+	})
+	return nil
+}
+
+// Discord rejects embeds with more than 25 fields, field names over 256
+// characters or more than 6000 characters in all; auditEmbedBudget leaves room
+// for the title and description.
+const (
+	maxEmbedFields   = 25
+	maxFieldName     = 256
+	auditEmbedBudget = 5000
+)
+
+func auditEmbed(entry *Database.AuditEntry) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title:       "📜 Configuration Changed",
+		Description: fmt.Sprintf("%s performed `%s`", auditActor(entry), entry.Action),
+		Color:       0x5865F2,
+	}
+	size := 0
+	for i, change := range entry.Changes {
+		name := change.Field
+		if runes := []rune(name); len(runes) > maxFieldName {
+			name = string(runes[:maxFieldName-3]) + "..."
+		}
+		value := fmt.Sprintf("%s → %s", auditValue(change.Before), auditValue(change.After))
+		size += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+		if i == maxEmbedFields || size > auditEmbedBudget {
+			embed.Description += fmt.Sprintf("\n…and %d more", len(entry.Changes)-i)
+			break
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: name, Value: value})
+	}
+	return embed
+}
+
+// auditActor mentions the Discord user who made a change. Changes made on the
+// command line have no Discord user, so they name the operating system user.
+func auditActor(entry *Database.AuditEntry) string {
+	if entry.ActorId == "cli" {
+		return fmt.Sprintf("`%s` (command line)", strings.ReplaceAll(entry.ActorName, "`", "'"))
+	}
+	return "<@" + entry.ActorId + ">"
+}
+
+// auditValue formats a value for an embed, keeping it within Discord's field limits.
+func auditValue(value string) string {
+	if value == "" {
+		return "*empty*"
+	}
+	if runes := []rune(value); len(runes) > 400 {
+		value = string(runes[:400]) + "..."
+	}
+	return "`" + strings.ReplaceAll(value, "`", "'") + "`"
+}
+
+func (b *Bot) handleAudit(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author.ID == s.State.User.ID {
+		return
+	}
+
+	// We only care about messages starting with "!audit"
+	if !strings.HasPrefix(m.Content, prefix+"audit") {
+		return
+	}
+
+	if !b.requireCapability(ctx, s, m, Permissions.ViewAudit, "view the audit log") {
+		return
+	}
+
+	parts := strings.Fields(m.Content)
+	if len(parts) >= 2 && parts[1] == "log" {
+		if len(parts) < 3 || (parts[2] != "here" && parts[2] != "off") {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!audit log <here|off>`")
+			return
+		}
+		channelID := ""
+		if parts[2] == "here" {
+			channelID = m.ChannelID
+		}
+		before := Audit.Take(ctx, b.db, m.GuildID)
+		if err := b.db.SetAuditChannel(ctx, m.GuildID, channelID); err != nil {
+			b.reportError(s, m, "setting audit channel", err)
+			return
+		}
+		b.auditChange(ctx, m.GuildID, m.Author, "audit.log", before)
+		if channelID == "" {
+			s.ChannelMessageSend(m.ChannelID, "✅ Audit entries will no longer be mirrored.")
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, "✅ Audit entries will be mirrored in this channel.")
+		return
+	}
+
+	// Everything else is a query: `!audit [user:<@user>] [action:<prefix>] [field:<prefix>] [limit:<n>]`
+	var filter Database.AuditFilter
+	for _, arg := range parts[1:] {
+		key, value, ok := strings.Cut(arg, ":")
+		if !ok {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!audit [user:<@user>] [action:<prefix>] [field:<prefix>] [limit:<1-25>]` or `!audit log <here|off>`")
+			return
+		}
+		switch key {
+		case "user":
+			filter.ActorId = strings.Trim(value, "<@!>")
+		case "action":
+			filter.Action = value
+		case "field":
+			filter.Field = value
+		case "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > 25 {
+				s.ChannelMessageSend(m.ChannelID, "The limit must be a number between 1 and 25.")
+				return
+			}
+			filter.Limit = int64(limit)
+		default:
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unknown filter `%s`. Use `user`, `action`, `field` or `limit`.", key))
+			return
+		}
+	}
+
+	entries, err := b.db.FindAuditEntries(ctx, m.GuildID, filter)
+	if err != nil {
+		b.reportError(s, m, "querying audit log", err)
+		return
+	}
+
+	var list strings.Builder
+	if len(entries) == 0 {
+		list.WriteString("No matching configuration changes.")
+	}
+	for _, entry := range entries {
+		fields := make([]string, len(entry.Changes))
+		for i, change := range entry.Changes {
+			fields[i] = change.Field
+		}
+		line := fmt.Sprintf("<t:%d:R> <@%s> `%s` — %s\n", entry.CreatedAt.Unix(), entry.ActorId, entry.Action, strings.Join(fields, ", "))
+		// Embed descriptions are capped at 4096 characters.
+		if list.Len()+len(line) > 4000 {
+			break
+		}
+		list.WriteString(line)
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       "📜 Audit Log",
+		Description: list.String(),
+		Color:       0x5865F2,
+		Footer: &discordgo.MessageEmbedFooter{
+			Text:    fmt.Sprintf("Requested by %s", m.Author.Username),
+			IconURL: m.Author.AvatarURL(""),
+		},
+	}
+	s.ChannelMessageSendEmbed(m.ChannelID, embed)
+}
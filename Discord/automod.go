@@ -0,0 +1,446 @@
+package Discord
+
+import (
+	"context"
+	"fmt"
+	"hellish/Audit"
+	"hellish/Database"
+	"hellish/Moderation"
+	"hellish/Permissions"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// handleAutoMod classifies messages in watched channels and acts on the ones that cross a threshold.
+func (b *Bot) handleAutoMod(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author.ID == s.State.User.ID || m.Author.Bot || m.GuildID == "" {
+		return
+	}
+	if strings.HasPrefix(m.Content, prefix) || strings.TrimSpace(m.Content) == "" {
+		return
+	}
+
+	settings, err := b.db.ViewAutoMod(ctx, m.GuildID)
+	if err != nil || !Moderation.Watches(settings, m.ChannelID) {
+		return
+	}
+
+	// Moderators and anyone granted bypass_limits are never auto-moderated. If
+	// that can't be checked, the message is moderated like any other.
+	exempt, err := b.hasCapability(ctx, s, m.GuildID, m.ChannelID, m.Author, m.Member, Permissions.BypassLimits)
+	if err != nil {
+		slog.Error("Error checking auto-mod exemption", "guild", m.GuildID, "user", m.Author.ID, "err", err)
+	}
+	if exempt {
+		return
+	}
+
+	decision, err := Moderation.Evaluate(ctx, b.ai, m.GuildID, settings, m.Content)
+	if ctx.Err() != nil {
+		// A deleted message needs no moderation.
+		return
+	}
+	if err != nil {
+		slog.Error("Error running auto-mod", "guild", m.GuildID, "err", err)
+		return
+	}
+	if decision == nil {
+		return
+	}
+
+	caseID, err := b.db.InsertAutoModCase(ctx, Database.AutoModCase{
+		ServerId:  m.GuildID,
+		ChannelId: m.ChannelID,
+		UserId:    m.Author.ID,
+		Category:  decision.Category,
+		Score:     decision.Score,
+		Action:    decision.Action,
+		Reason:    decision.Reason,
+		Content:   m.Content,
+	})
+	if err != nil {
+		slog.Error("Error recording auto-mod case", "guild", m.GuildID, "err", err)
+	}
+
+	if Moderation.Includes(decision.Action, "delete") {
+		if err := s.ChannelMessageDelete(m.ChannelID, m.ID); err != nil {
+			slog.Error("Error deleting message flagged by auto-mod", "guild", m.GuildID, "err", err)
+		}
+	}
+	if Moderation.Includes(decision.Action, "timeout") {
+		until := time.Now().Add(time.Duration(Moderation.TimeoutMinutes(settings)) * time.Minute)
+		if err := s.GuildMemberTimeout(m.GuildID, m.Author.ID, &until); err != nil {
+			slog.Error("Error timing out user", "guild", m.GuildID, "user", m.Author.ID, "err", err)
+		}
+	}
+	if Moderation.Includes(decision.Action, "warn") {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("⚠️ <@%s>, watch it. your message was flagged for **%s**.", m.Author.ID, decision.Category))
+		if caseID != "" {
+			sendAppealPrompt(s, m.Author.ID, caseID, decision)
+		}
+	}
+
+	if settings.LogChannel != "" {
+		embed := autoModEmbed(caseID, m.Author.ID, m.ChannelID, decision, m.Content)
+		if _, err := s.ChannelMessageSendEmbed(settings.LogChannel, embed); err != nil {
+			slog.Error("Error sending auto-mod log", "guild", m.GuildID, "err", err)
+		}
+	}
+}
+
+// sendAppealPrompt DMs the user about the action with a button to appeal it.
+func sendAppealPrompt(s *discordgo.Session, userID, caseID string, decision *Moderation.Decision) {
+	channel, err := s.UserChannelCreate(userID)
+	if err != nil {
+		slog.Error("Error opening DM", "user", userID, "err", err)
+		return
+	}
+	_, err = s.ChannelMessageSendComplex(channel.ID, &discordgo.MessageSend{
+		Content: fmt.Sprintf("Your message was flagged for **%s** and the auto-mod took action (`%s`). If you think this was a mistake, you can appeal.", decision.Category, decision.Action),
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "Appeal",
+						Style:    discordgo.SecondaryButton,
+						CustomID: "automod_appeal:" + caseID,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending appeal prompt", "user", userID, "err", err)
+	}
+}
+
+// messageExcerpt prepares a member's message for an embed field. It is cut to
+// 500 characters so that, even with every character escaped, it stays within
+// Discord's 1024-character field limit.
+func messageExcerpt(content string) string {
+	if runes := []rune(content); len(runes) > 500 {
+		content = string(runes[:500]) + "..."
+	}
+	return valueOrNone(Moderation.EscapeMarkdown(content))
+}
+
+func autoModEmbed(caseID, userID, channelID string, decision *Moderation.Decision, content string) *discordgo.MessageEmbed {
+	return &discordgo.MessageEmbed{
+		Title: "🚨 Auto-Mod Action",
+		Color: 0xED4245,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "User", Value: "<@" + userID + ">", Inline: true},
+			{Name: "Channel", Value: "<#" + channelID + ">", Inline: true},
+			{Name: "Action", Value: decision.Action, Inline: true},
+			{Name: "Category", Value: fmt.Sprintf("%s (%.2f)", decision.Category, decision.Score), Inline: true},
+			{Name: "Reason", Value: valueOrNone(decision.Reason)},
+			{Name: "Message", Value: messageExcerpt(content)},
+		},
+		Footer: &discordgo.MessageEmbedFooter{Text: "Case " + valueOrNone(caseID)},
+	}
+}
+
+// handleAutoModInteraction handles the appeal button, the appeal modal and the
+// moderator accept/deny buttons. Custom IDs carry the case ID after a colon.
+func (b *Bot) handleAutoModInteraction(ctx context.Context, s *discordgo.Session, i *discordgo.InteractionCreate, customID string) {
+	kind, caseID, _ := strings.Cut(customID, ":")
+
+	switch kind {
+	case "automod_appeal":
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseModal,
+			Data: &discordgo.InteractionResponseData{
+				CustomID: "automod_appeal_modal:" + caseID,
+				Title:    "Appeal Auto-Mod Action",
+				Components: []discordgo.MessageComponent{
+					discordgo.ActionsRow{
+						Components: []discordgo.MessageComponent{
+							discordgo.TextInput{
+								CustomID:  "automod_appeal_input",
+								Label:     "Why should this be reversed?",
+								Style:     discordgo.TextInputParagraph,
+								Required:  true,
+								MaxLength: 1000,
+							},
+						},
+					},
+				},
+			},
+		})
+		if err != nil {
+			slog.Error("Error showing appeal modal", "err", err)
+		}
+
+	case "automod_appeal_modal":
+		appeal := i.ModalSubmitData().Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+		c, err := b.db.FindAutoModCase(ctx, caseID)
+		if err == nil && c.UserId != interactionUserID(i) {
+			err = fmt.Errorf("case does not belong to this user")
+		}
+		if err == nil {
+			err = b.db.AppealAutoModCase(ctx, caseID, appeal)
+		}
+		if err != nil {
+			slog.Error("Error submitting appeal", "case", caseID, "err", err)
+			respondEphemeral(s, i, "❌ This appeal could not be submitted. It may already have been appealed.")
+			return
+		}
+
+		settings, err := b.db.ViewAutoMod(ctx, c.ServerId)
+		if err == nil && settings.LogChannel != "" {
+			_, err = s.ChannelMessageSendComplex(settings.LogChannel, &discordgo.MessageSend{
+				Embed: &discordgo.MessageEmbed{
+					Title: "📨 Auto-Mod Appeal",
+					Color: 0xFEE75C,
+					Fields: []*discordgo.MessageEmbedField{
+						{Name: "User", Value: "<@" + c.UserId + ">", Inline: true},
+						{Name: "Action", Value: c.Action, Inline: true},
+						{Name: "Category", Value: c.Category, Inline: true},
+						{Name: "Original Message", Value: messageExcerpt(c.Content)},
+						{Name: "Appeal", Value: appeal},
+					},
+					Footer: &discordgo.MessageEmbedFooter{Text: "Case " + caseID},
+				},
+				Components: []discordgo.MessageComponent{
+					discordgo.ActionsRow{
+						Components: []discordgo.MessageComponent{
+							discordgo.Button{Label: "Accept", Style: discordgo.SuccessButton, CustomID: "automod_accept:" + caseID},
+							discordgo.Button{Label: "Deny", Style: discordgo.DangerButton, CustomID: "automod_deny:" + caseID},
+						},
+					},
+				},
+			})
+			if err != nil {
+				slog.Error("Error posting appeal", "case", caseID, "err", err)
+			}
+		}
+		respondEphemeral(s, i, "✅ Your appeal has been sent to the moderators.")
+
+	case "automod_accept", "automod_deny":
+		if !b.requireInteractionCapability(ctx, s, i, Permissions.ManageModeration, "resolve appeals") {
+			return
+		}
+
+		status := "denied"
+		if kind == "automod_accept" {
+			status = "accepted"
+		}
+		c, err := b.db.FindAutoModCase(ctx, caseID)
+		if err == nil {
+			err = b.db.ResolveAutoModCase(ctx, caseID, status, interactionUserID(i))
+		}
+		if err != nil {
+			slog.Error("Error resolving case", "case", caseID, "err", err)
+			respondEphemeral(s, i, "❌ This appeal could not be resolved. It may already have been handled.")
+			return
+		}
+
+		if status == "accepted" && c.Action == "timeout" {
+			if err := s.GuildMemberTimeout(c.ServerId, c.UserId, nil); err != nil {
+				slog.Error("Error lifting timeout", "guild", c.ServerId, "user", c.UserId, "err", err)
+			}
+		}
+		if channel, err := s.UserChannelCreate(c.UserId); err == nil {
+			s.ChannelMessageSend(channel.ID, fmt.Sprintf("Your auto-mod appeal was **%s** by the moderators.", status))
+		}
+
+		// Replace the buttons with the outcome so the appeal can't be resolved twice.
+		embeds := i.Message.Embeds
+		if len(embeds) > 0 {
+			embeds[0].Fields = append(embeds[0].Fields, &discordgo.MessageEmbedField{
+				Name:  "Outcome",
+				Value: fmt.Sprintf("%s by <@%s>", status, interactionUserID(i)),
+			})
+		}
+		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: &discordgo.InteractionResponseData{
+				Embeds:     embeds,
+				Components: []discordgo.MessageComponent{},
+			},
+		})
+		if err != nil {
+			slog.Error("Error updating appeal message", "err", err)
+		}
+	}
+}
+
+func (b *Bot) handleAutoModCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author.ID == s.State.User.ID {
+		return
+	}
+
+	// We only care about messages starting with "!automod"
+	if !strings.HasPrefix(m.Content, prefix+"automod") {
+		return
+	}
+
+	usage := "Usage: `!automod <view|on|off|channel|threshold|action|timeout|log> [args]`"
+	parts := strings.Fields(m.Content)
+	if len(parts) < 2 {
+		s.ChannelMessageSend(m.ChannelID, usage)
+		return
+	}
+
+	subcommand := parts[1]
+
+	if subcommand != "view" && !b.requireCapability(ctx, s, m, Permissions.ManageModeration, "change auto-mod settings") {
+		return
+	}
+
+	var err error
+	var confirmation string
+	before := Audit.Take(ctx, b.db, m.GuildID)
+
+	switch subcommand {
+	case "view":
+		settings, err := b.db.ViewAutoMod(ctx, m.GuildID)
+		if err != nil {
+			b.reportError(s, m, "viewing auto-mod settings", err)
+			return
+		}
+
+		status := "Off"
+		if settings.Enabled {
+			status = "On"
+		}
+		channels := make([]string, len(settings.Channels))
+		for i, id := range settings.Channels {
+			channels[i] = "<#" + id + ">"
+		}
+		var rules strings.Builder
+		for _, category := range Moderation.Categories {
+			rules.WriteString(fmt.Sprintf("• **%s**: `%s` at %.2f\n", category, Moderation.Action(settings, category), Moderation.Threshold(settings, category)))
+		}
+		logChannel := "Not set"
+		if settings.LogChannel != "" {
+			logChannel = "<#" + settings.LogChannel + ">"
+		}
+
+		embed := &discordgo.MessageEmbed{
+			Title: "🚨 Auto-Mod Settings",
+			Color: 0x5865F2,
+			Fields: []*discordgo.MessageEmbedField{
+				{Name: "Status", Value: status, Inline: true},
+				{Name: "Timeout Length", Value: fmt.Sprintf("%d minutes", Moderation.TimeoutMinutes(settings)), Inline: true},
+				{Name: "Mod Channel", Value: logChannel, Inline: true},
+				{Name: "Watched Channels", Value: listOrNone(channels, "")},
+				{Name: "Rules", Value: rules.String()},
+			},
+		}
+		s.ChannelMessageSendEmbed(m.ChannelID, embed)
+		return
+
+	case "on", "off":
+		err = b.db.SetAutoModEnabled(ctx, m.GuildID, subcommand == "on")
+		confirmation = fmt.Sprintf("✅ Auto-mod is now %s.", subcommand)
+
+	case "channel":
+		if len(parts) < 3 || (parts[2] != "add" && parts[2] != "remove") {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!automod channel <add|remove>` (applies to the current channel)")
+			return
+		}
+		if parts[2] == "add" {
+			err = b.db.AddAutoModChannel(ctx, m.GuildID, m.ChannelID)
+			confirmation = "✅ Auto-mod is now watching this channel."
+		} else {
+			err = b.db.RemoveAutoModChannel(ctx, m.GuildID, m.ChannelID)
+			confirmation = "✅ Auto-mod is no longer watching this channel."
+		}
+
+	case "threshold":
+		if len(parts) < 4 || !slices.Contains(Moderation.Categories, parts[2]) {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!automod threshold <toxicity|spam|scam> <0-1>`")
+			return
+		}
+		threshold, perr := strconv.ParseFloat(parts[3], 64)
+		if perr != nil || threshold < 0 || threshold > 1 {
+			s.ChannelMessageSend(m.ChannelID, "The threshold must be a number between 0 and 1.")
+			return
+		}
+		err = b.db.SetAutoModThreshold(ctx, m.GuildID, parts[2], threshold)
+		confirmation = fmt.Sprintf("✅ The %s threshold is now %.2f.", parts[2], threshold)
+
+	case "action":
+		if len(parts) < 4 || !slices.Contains(Moderation.Categories, parts[2]) || !slices.Contains(Moderation.Actions, parts[3]) {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!automod action <toxicity|spam|scam> <log|delete|warn|timeout>`")
+			return
+		}
+		err = b.db.SetAutoModAction(ctx, m.GuildID, parts[2], parts[3])
+		confirmation = fmt.Sprintf("✅ Messages flagged for %s will now get `%s`.", parts[2], parts[3])
+
+	case "timeout":
+		minutes := 0
+		if len(parts) >= 3 {
+			minutes, _ = strconv.Atoi(parts[2])
+		}
+		// Discord caps timeouts at 28 days.
+		if minutes < 1 || minutes > 28*24*60 {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!automod timeout <minutes>` (1 to 40320)")
+			return
+		}
+		err = b.db.SetAutoModTimeout(ctx, m.GuildID, minutes)
+		confirmation = fmt.Sprintf("✅ Auto-mod timeouts now last %d minutes.", minutes)
+
+	case "log":
+		if len(parts) < 3 || (parts[2] != "here" && parts[2] != "off") {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!automod log <here|off>`")
+			return
+		}
+		channelID := ""
+		confirmation = "✅ Auto-mod actions will no longer be logged."
+		if parts[2] == "here" {
+			channelID = m.ChannelID
+			confirmation = "✅ Auto-mod actions and appeals will be posted in this channel."
+		}
+		err = b.db.SetAutoModLogChannel(ctx, m.GuildID, channelID)
+
+	default:
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unknown subcommand `%s`. %s", subcommand, usage))
+		return
+	}
+
+	if err != nil {
+		b.reportError(s, m, "updating auto-mod settings", err)
+		return
+	}
+	b.auditChange(ctx, m.GuildID, m.Author, "automod."+subcommand, before)
+	s.ChannelMessageSend(m.ChannelID, confirmation)
+}
+
+// interactionUserID returns the ID of the user behind an interaction, which is
+// carried on Member in guilds and on User in DMs.
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		slog.Error("Error responding to interaction", "err", err)
+	}
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "None"
+	}
+	return value
+}
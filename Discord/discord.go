@@ -1,48 +1,165 @@
 package Discord
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"hellish/AI"
+	"hellish/Audit"
 	"hellish/Database"
-	"log"
+	"hellish/Health"
+	"hellish/Logging"
+	"hellish/Metrics"
+	"hellish/Moderation"
+	"hellish/Permissions"
+	"hellish/Tracing"
+	"log/slog"
 	"os"
 	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var prefix = "!"
 
-func Dc() {
+// Bot holds the dependencies the Discord handlers share.
+type Bot struct {
+	db        *Database.DB
+	ai        *AI.Client
+	lifecycle *lifecycle
+	shards    *shardManager
+	chat      *chatQueue
+	// replyReference sends AI replies as replies to the user's message.
+	replyReference bool
+}
+
+// Dc connects the shards this process runs to Discord and serves the bot until
+// ctx is cancelled. It then stops handling new events, waits up to
+// SHUTDOWN_TIMEOUT for running handlers, cancels the ones still going and
+// closes the gateway sessions.
+func Dc(ctx context.Context, db *Database.DB, ai *AI.Client) error {
+	b := &Bot{db: db, ai: ai, lifecycle: newLifecycle()}
+	b.chat = newChatQueue(b)
+	b.replyReference = os.Getenv("CHAT_REPLY_REFERENCE") != "false"
 
 	token := os.Getenv("BOT_TOKEN")
 	if token == "" {
-		log.Fatal("BOT_TOKEN not found in environment variables")
+		return fmt.Errorf("BOT_TOKEN not found in environment variables")
 	}
 
-	sess, err := discordgo.New("Bot " + token)
-	if err != nil {
-		panic(err)
-	}
-	sess.AddHandler(handleChat)
-	sess.AddHandler(helpCommand)
-	sess.AddHandler(handleButtonInteraction)
-	sess.AddHandler(activeCommand)
-	sess.AddHandler(handleSystemMessage)
-	sess.AddHandler(handleAPI)
-	sess.Identify.Intents = discordgo.IntentsAllWithoutPrivileged | discordgo.IntentsMessageContent
-	err = sess.Open()
+	config, err := loadShardConfig()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	count, maxConcurrency := config.count, 1
+	if count == 0 {
+		if count, maxConcurrency, err = recommendedShards(token); err != nil {
+			return err
+		}
+	}
+	for _, id := range config.ids {
+		if id >= count {
+			return fmt.Errorf("shard %d is out of range for %d shards", id, count)
+		}
+	}
+	b.shards = newShardManager(b, token, count, maxConcurrency)
+	expvar.Publish("shards", expvar.Func(func() any { return b.shards.Health() }))
+	Health.Live("gateway", b.shards.checkHeartbeats)
+
+	var coordinator *coordinator
+	if config.coordinated {
+		coordinator = newCoordinator(b.shards, db, config.processes)
+		Health.Ready("shards", coordinator.checkReady)
+		go coordinator.run(ctx)
+	} else {
+		Health.Ready("shards", b.shards.checkReady)
+		ids := config.ids
+		if ids == nil {
+			for id := 0; id < count; id++ {
+				ids = append(ids, id)
+			}
+		}
+		slog.Info("Starting shards", "shards", count, "ids", ids)
+		for _, id := range ids {
+			if err := b.shards.start(ctx, id); err != nil {
+				b.shards.stopAll()
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+
+	<-ctx.Done()
+	timeout := drainTimeout()
+	slog.Info("Shutting down, waiting for running handlers", "timeout", timeout)
+	if !b.lifecycle.drain(timeout) {
+		slog.Warn("Handlers still running after the shutdown timeout, closing anyway")
+	}
+	if coordinator != nil {
+		coordinator.release()
+	} else {
+		b.shards.stopAll()
+	}
+	slog.Info("Disconnected from Discord")
+	return nil
+}
+
+// addHandlers registers the bot's event handlers on a shard's session.
+func (b *Bot) addHandlers(sess *discordgo.Session) {
+	l := b.lifecycle
+	sess.AddHandler(countMessage)
+	sess.AddHandler(guard(l, b.handleChat))
+	sess.AddHandler(guard(l, helpCommand))
+	sess.AddHandler(guard(l, b.handleButtonInteraction))
+	sess.AddHandler(guard(l, b.activeCommand))
+	sess.AddHandler(guard(l, b.handleSystemMessage))
+	sess.AddHandler(guard(l, b.handleAPI))
+	sess.AddHandler(guard(l, b.handleModeration))
+	sess.AddHandler(guard(l, b.handleAutoMod))
+	sess.AddHandler(guard(l, b.handleAutoModCommand))
+	sess.AddHandler(guard(l, b.handleAudit))
+	sess.AddHandler(guard(l, b.handlePerms))
+	sess.AddHandler(guard(l, b.handleAccess))
+	sess.AddHandler(guard(l, b.handleRef))
+	// Deleting a message cancels the reply or auto-mod check still running for it.
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.MessageDelete) { l.abandon(m.ID) })
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.MessageDeleteBulk) { l.abandon(m.Messages...) })
+}
+
+// commandNames are the commands counted by name in metrics. Anything else
+// after the prefix counts as "unknown", so users can't create new series.
+var commandNames = map[string]bool{
+	"help": true, "activate": true, "system": true, "api": true, "moderation": true, "automod": true,
+	"audit": true, "perms": true, "access": true, "ref": true,
+}
+
+// countMessage counts a server message by command in the messages metric.
+func countMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.GuildID == "" || m.Author == nil || m.Author.ID == s.State.User.ID {
+		return
 	}
-	defer sess.Close()
-	fmt.Println("Bot is running")
+	Metrics.Messages.Inc(m.GuildID, commandName(m))
+}
 
-	// Keep the bot running
-	select {}
+// commandName returns the command a message is routed to, "chat" if it has
+// none, or "unknown".
+func commandName(m *discordgo.MessageCreate) string {
+	if !strings.HasPrefix(m.Content, prefix) {
+		return "chat"
+	}
+	if fields := strings.Fields(strings.TrimPrefix(m.Content, prefix)); len(fields) > 0 && commandNames[fields[0]] {
+		return fields[0]
+	}
+	return "unknown"
 }
 
 // helpCommand updated to show only implemented commands.
-func helpCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+func helpCommand(_ context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	if m.Author.ID == s.State.User.ID || m.Content != prefix+"help" {
 		return
 	}
@@ -65,7 +182,7 @@ func helpCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
 		Fields: []*discordgo.MessageEmbedField{
 			{
 				Name:   "📋 Available Categories",
-				Value:  "🔧 **Channel Management**\n⚙️ **Configuration**",
+				Value:  "🔧 **Channel Management**\n⚙️ **Configuration**\n🛡️ **Moderation**",
 				Inline: false,
 			},
 		},
@@ -87,6 +204,11 @@ func helpCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
 			Value:       "help_config",
 			Description: "Commands to configure AI behavior and API keys.",
 		},
+		{
+			Label:       "Moderation",
+			Value:       "help_moderation",
+			Description: "Commands to control what the AI is allowed to say.",
+		},
 	}
 
 	selectMenu := discordgo.SelectMenu{
@@ -106,44 +228,37 @@ func helpCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
 		Components: components,
 	})
 	if err != nil {
-		log.Printf("Error sending help embed: %v", err)
+		slog.Error("Error sending help embed", "err", err)
 	}
 }
-func handleButtonInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) {
+func (b *Bot) handleButtonInteraction(ctx context.Context, s *discordgo.Session, i *discordgo.InteractionCreate) {
 
 	switch i.Type {
 
 	case discordgo.InteractionMessageComponent:
-		handleComponentInteraction(s, i)
+		b.handleComponentInteraction(ctx, s, i)
 
 	case discordgo.InteractionModalSubmit:
-		handleModalSubmit(s, i)
+		b.handleModalSubmit(ctx, s, i)
 	}
 }
 
 // handleComponentInteraction updated to handle the new help menu.
-func handleComponentInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) {
+func (b *Bot) handleComponentInteraction(ctx context.Context, s *discordgo.Session, i *discordgo.InteractionCreate) {
 	data := i.MessageComponentData()
 	customID := data.CustomID
 
+	if strings.HasPrefix(customID, "automod_") {
+		b.handleAutoModInteraction(ctx, s, i, customID)
+		return
+	}
+
 	if customID == "add_api_key_button" {
-		perms, err := s.UserChannelPermissions(i.Member.User.ID, i.ChannelID)
-		if err != nil {
-			log.Printf("Error getting user permissions for %s: %v", i.Member.User.ID, err)
-			return
-		}
-		if perms&discordgo.PermissionManageGuild == 0 {
-			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-				Type: discordgo.InteractionResponseChannelMessageWithSource,
-				Data: &discordgo.InteractionResponseData{
-					Content: "You need the `Manage Server` permission to use this button.",
-					Flags:   discordgo.MessageFlagsEphemeral,
-				},
-			})
+		if !b.requireInteractionCapability(ctx, s, i, Permissions.ManageKeys, "use this button") {
 			return
 		}
 
-		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseModal,
 			Data: &discordgo.InteractionResponseData{
 				CustomID: "api_key_modal",
@@ -166,7 +281,7 @@ func handleComponentInteraction(s *discordgo.Session, i *discordgo.InteractionCr
 			},
 		})
 		if err != nil {
-			log.Printf("Error showing modal: %v", err)
+			slog.Error("Error showing modal", "err", err)
 		}
 		return
 	}
@@ -189,7 +304,7 @@ func handleComponentInteraction(s *discordgo.Session, i *discordgo.InteractionCr
 				Fields: []*discordgo.MessageEmbedField{
 					{
 						Name:  "🟢 `!activate`",
-						Value: "**Function:** Enables me to respond to messages in the current channel.\n**Permission:** `Manage Server`",
+						Value: "**Function:** Enables me to respond to messages in the current channel.\n**Capability:** `activate`",
 					},
 				},
 			}
@@ -202,11 +317,44 @@ func handleComponentInteraction(s *discordgo.Session, i *discordgo.InteractionCr
 				Fields: []*discordgo.MessageEmbedField{
 					{
 						Name:  "🔑 `!api <add|view|remove|clear>`",
-						Value: "**Function:** Manages the Gemini API keys I use for this server.\n• `add`: Opens a secure pop-up to add a key.\n• `view`: Shows a count of registered keys.\n• `remove <key>`: Removes a specific key.\n• `clear`: Removes all keys.\n**Permission:** `Manage Server` for modifying commands.",
+						Value: "**Function:** Manages the Gemini API keys I use for this server.\n• `add`: Opens a secure pop-up to add a key.\n• `view`: Shows a count of registered keys.\n• `remove <key>`: Removes a specific key.\n• `clear`: Removes all keys.\n**Capability:** `manage_keys` for modifying commands.",
 					},
 					{
 						Name:  "📝 `!system <set|view|clear>`",
-						Value: "**Function:** Manages the custom instructions I use for this server.\n• `set <message>`: Sets the system message.\n• `view`: Shows the current message.\n• `clear`: Clears the message.\n**Permission:** `Manage Server` for modifying commands.",
+						Value: "**Function:** Manages the custom instructions I use for this server.\n• `set <message>`: Sets the system message.\n• `view`: Shows the current message.\n• `clear`: Clears the message.\n**Capability:** `edit_system` for modifying commands.",
+					},
+					{
+						Name:  "🚪 `!access <view|notice|server|channel>`",
+						Value: "**Function:** Controls who may chat with me.\n• `view`: Shows the server and channel lists.\n• `<server|channel> <allow|deny> <add|remove> <@role|@user>`: Edits a list.\n• `notice <on|off>`: Tells ignored users why.\nDeny entries always win.\n**Capability:** `manage_access` for modifying commands.",
+					},
+					{
+						Name:  "🔐 `!perms <list|grant|revoke>`",
+						Value: "**Function:** Grants bot capabilities to roles or users.\n• `list`: Shows every capability and who holds it.\n• `grant <capability> <@role|@user>`: Grants a capability.\n• `revoke <capability> <@role|@user>`: Revokes it.\nOnce a capability is granted to anyone, only they (and `Manage Server` members) keep it.\n**Permission:** `Manage Server`",
+					},
+					{
+						Name:  "📜 `!audit [filters]` / `!audit log <here|off>`",
+						Value: "**Function:** Shows recent configuration changes, who made them, and what changed.\n• Filters: `user:<@user>`, `action:<prefix>`, `field:<prefix>`, `limit:<1-25>`\n• `log <here|off>`: Mirrors every change to this channel.\n**Capability:** `view_audit`",
+					},
+					{
+						Name:  "🔎 `!ref <reference>`",
+						Value: "**Function:** Explains an error. When something goes wrong I reply with a reference like `ref 1a2b3c4d`; this shows what failed and why.\n**Capability:** `view_audit`",
+					},
+				},
+			}
+		case "help_moderation":
+			embed = &discordgo.MessageEmbed{
+				Title:       "🛡️ Moderation Commands",
+				Description: "Every reply is checked before it is posted. Blocked replies are swapped for a refusal and reported.",
+				Color:       0x5865F2,
+				Thumbnail:   &discordgo.MessageEmbedThumbnail{URL: botAvatarURL},
+				Fields: []*discordgo.MessageEmbedField{
+					{
+						Name:  "🛡️ `!moderation <view|word|pattern|classifier|log|mentions|invites|links|emoji|markdown>`",
+						Value: "**Function:** Manages how my replies are moderated.\n• `view`: Shows the current settings.\n• `word <add|remove> <word>`: Edits the blocked word list.\n• `pattern <add|remove> <regex>`: Edits the blocked pattern list.\n• `classifier <on|off>`: Toggles a second AI safety check.\n• `log <here|off>`: Reports withheld replies in this channel.\n• `mentions <none|author|users>`: Sets who my replies may ping.\n• `invites <strip|allow>`, `links <neutralize|allow>`: Controls invite and masked links in my replies.\n• `emoji <max|off>`, `markdown <fix|raw>`: Caps emoji and fixes broken formatting.\n**Capability:** `manage_moderation` for modifying commands.",
+					},
+					{
+						Name:  "🚨 `!automod <view|on|off|channel|threshold|action|timeout|log>`",
+						Value: "**Function:** Lets me moderate incoming messages in watched channels.\n• `on`/`off`: Enables or disables the auto-mod.\n• `channel <add|remove>`: Watches or stops watching this channel.\n• `threshold <category> <0-1>`: Sets when a category triggers.\n• `action <category> <log|delete|warn|timeout>`: Sets what happens.\n• `timeout <minutes>`: Sets the timeout length.\n• `log <here|off>`: Posts actions and appeals in this channel.\n**Categories:** `toxicity`, `spam`, `scam`\n**Capability:** `manage_moderation` for modifying commands.",
 					},
 				},
 			}
@@ -220,34 +368,47 @@ func handleComponentInteraction(s *discordgo.Session, i *discordgo.InteractionCr
 			},
 		})
 		if err != nil {
-			log.Printf("Error responding to help menu interaction: %v", err)
+			slog.Error("Error responding to help menu interaction", "err", err)
 		}
 	}
 }
 
-func handleModalSubmit(s *discordgo.Session, i *discordgo.InteractionCreate) {
+func (b *Bot) handleModalSubmit(ctx context.Context, s *discordgo.Session, i *discordgo.InteractionCreate) {
 	data := i.ModalSubmitData()
 
+	if strings.HasPrefix(data.CustomID, "automod_") {
+		b.handleAutoModInteraction(ctx, s, i, data.CustomID)
+		return
+	}
+
 	// Ensure we're handling the correct modal
 	if data.CustomID != "api_key_modal" {
 		return
 	}
 
+	if !b.requireInteractionCapability(ctx, s, i, Permissions.ManageKeys, "add API keys") {
+		return
+	}
+
 	apiKey := data.Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
 
-	err := Database.AddAPIKey(i.GuildID, apiKey)
+	before := Audit.Take(ctx, b.db, i.GuildID)
+	err := b.db.AddAPIKey(ctx, i.GuildID, apiKey)
 	if err != nil {
-		log.Printf("Error adding API key via modal for guild %s: %v", i.GuildID, err)
-
+		content := "❌ That API key is already in the list."
+		if !errors.Is(err, Database.ErrDuplicateAPIKey) {
+			content = "❌ " + Logging.UserError(i.GuildID, "adding API key", err)
+		}
 		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
 			Data: &discordgo.InteractionResponseData{
-				Content: "❌ An error occurred while saving the API key. It might already be in the list, or the database is unavailable.",
+				Content: content,
 				Flags:   discordgo.MessageFlagsEphemeral,
 			},
 		})
 		return
 	}
+	b.auditChange(ctx, i.GuildID, i.Member.User, "api.add", before)
 
 	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
@@ -257,11 +418,11 @@ func handleModalSubmit(s *discordgo.Session, i *discordgo.InteractionCreate) {
 		},
 	})
 	if err != nil {
-		log.Printf("Error sending modal confirmation: %v", err)
+		slog.Error("Error sending modal confirmation", "err", err)
 	}
 }
 
-func activeCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (b *Bot) activeCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	if m.Author.ID == s.State.User.ID {
 		return
 	}
@@ -271,15 +432,22 @@ func activeCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
 	if m.Content != "!activate" {
 		return
 	}
-	channelID, err := Database.FindChannel(m.GuildID)
+	if !b.requireCapability(ctx, s, m, Permissions.Activate, "activate the AI in a channel") {
+		return
+	}
+	channelID, err := b.db.FindChannel(ctx, m.GuildID)
 	if err != nil {
-		log.Println(err)
+		// A server that was never activated has no channel yet.
+		slog.Debug("No active channel", "guild", m.GuildID, "err", err)
 	}
 	if channelID == "" || channelID != m.ChannelID {
-		err := Database.InsertChannel(m.GuildID, m.ChannelID)
+		before := Audit.Take(ctx, b.db, m.GuildID)
+		err := b.db.InsertChannel(ctx, m.GuildID, m.ChannelID)
 		if err != nil {
-			log.Fatal(err)
+			b.reportError(s, m, "activating channel", err)
+			return
 		}
+		b.auditChange(ctx, m.GuildID, m.Author, "channel.activate", before)
 		_, err = s.ChannelMessageSend(m.ChannelID, "AI is now active in this channel")
 		if err != nil {
 			return
@@ -292,7 +460,7 @@ func activeCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
 	}
 }
 
-func handleChat(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (b *Bot) handleChat(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	if m.Author.ID == s.State.User.ID {
 		return
 	}
@@ -300,37 +468,90 @@ func handleChat(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
-	channelId, err := Database.FindChannel(m.GuildID)
+	channelId, err := b.db.FindChannel(ctx, m.GuildID)
 	if err != nil {
 		return
 	}
 	if channelId != m.ChannelID {
 		return
 	}
-	systemMessage, err := Database.ViewSystemMessage(m.GuildID)
+	if !b.canChat(ctx, s, m) {
+		return
+	}
+	b.chat.submit(ctx, s, m)
+}
+
+// reply answers a turn of one or more messages in a row from the same user.
+func (b *Bot) reply(ctx context.Context, s *discordgo.Session, turn []*discordgo.MessageCreate) {
+	m := turn[len(turn)-1]
+	ctx, span := Tracing.Start(ctx, "chat.reply", attribute.Int("chat.turn_messages", len(turn)))
+	defer span.End()
+	stopTyping := keepTyping(ctx, s, m.ChannelID)
+	defer stopTyping()
+
+	config, err := b.db.ViewServer(ctx, m.GuildID)
 	if err != nil {
+		Tracing.Fail(span, err)
 		return
 	}
+	persona := AI.GetBasePersona()
+	if config.Persona != "" {
+		persona = config.Persona
+	}
+	contents := make([]string, len(turn))
+	for i, message := range turn {
+		contents[i] = message.Content
+	}
 	input :=
 		`
 		UserInput :
-		` + m.Content +
+		` + strings.Join(contents, "\n") +
 			`
 		SystemMessage :
-		` + systemMessage + `
+		` + config.SystemMessage + `
 			user name : ` + m.Author.Username + `
 		`
-	res, err := AI.Response(m.GuildID, AI.GetBasePersona(), input)
+	reply, err := b.ai.Generate(ctx, m.GuildID, persona, input)
 	if err != nil {
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
+		Tracing.Fail(span, err)
+		if ctx.Err() != nil {
+			// The messages were deleted or the bot is shutting down; nobody is waiting.
+			slog.Debug("Reply cancelled", "guild", m.GuildID, "message", m.ID, "err", ctx.Err())
+			return
+		}
+		stopTyping()
+		if verdict, blocked := Moderation.CheckError(err); blocked {
+			b.withholdReply(ctx, s, m, verdict, "")
+			return
+		}
+		if errors.Is(err, AI.ErrNoAPIKeys) {
+			s.ChannelMessageSend(m.ChannelID, "No API keys are configured for this server. Please use `!api add` to add one.")
+			return
+		}
+		b.reportError(s, m, "generating reply", err)
+		return
+	}
+	if err := b.db.RecordUsage(ctx, m.GuildID, reply.PromptTokens, reply.OutputTokens); err != nil {
+		slog.Warn("Error recording usage", "guild", m.GuildID, "err", err)
 	}
-	_, err = s.ChannelMessageSend(m.ChannelID, res)
+	settings := config.Moderation
+	verdict, err := Moderation.CheckReply(ctx, b.ai, m.GuildID, settings, isNSFW(s, m.ChannelID), reply)
 	if err != nil {
+		slog.Error("Error moderating reply", "guild", m.GuildID, "err", err)
+		verdict = Moderation.Verdict{Blocked: true, Source: "error", Reason: "moderation check failed"}
+	}
+	stopTyping()
+	if verdict.Blocked {
+		span.AddEvent("reply withheld", trace.WithAttributes(attribute.String("moderation.source", verdict.Source)))
+		b.withholdReply(ctx, s, m, verdict, reply.Text)
 		return
 	}
+	if err := b.sendReply(ctx, s, m, Moderation.Sanitize(reply.Text, settings.Output), settings.Output); err != nil {
+		slog.Error("Error sending reply", "guild", m.GuildID, "channel", m.ChannelID, "err", err)
+	}
 }
 
-func handleSystemMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (b *Bot) handleSystemMessage(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	if m.Author.ID == s.State.User.ID {
 		return
 	}
@@ -352,15 +573,7 @@ func handleSystemMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
 
 	switch subcommand {
 	case "set":
-		// Check for 'Manage Server' permission
-		perms, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
-		if err != nil {
-			log.Printf("Error getting user permissions for %s: %v", m.Author.ID, err)
-			s.ChannelMessageSend(m.ChannelID, "Could not verify your permissions. Please try again.")
-			return
-		}
-		if perms&discordgo.PermissionManageGuild == 0 {
-			s.ChannelMessageSend(m.ChannelID, "You need the `Manage Server` permission to set the system message.")
+		if !b.requireCapability(ctx, s, m, Permissions.EditSystem, "set the system message") {
 			return
 		}
 
@@ -370,19 +583,19 @@ func handleSystemMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
 		}
 
 		message := strings.Join(parts[2:], " ")
-		err = Database.InsertSystemMessage(m.GuildID, message)
+		before := Audit.Take(ctx, b.db, m.GuildID)
+		err := b.db.InsertSystemMessage(ctx, m.GuildID, message)
 		if err != nil {
-			log.Printf("Error setting system message for guild %s: %v", m.GuildID, err)
-			s.ChannelMessageSend(m.ChannelID, "An error occurred while updating the system message.")
+			b.reportError(s, m, "setting system message", err)
 			return
 		}
+		b.auditChange(ctx, m.GuildID, m.Author, "system.set", before)
 		s.ChannelMessageSend(m.ChannelID, "✅ System message has been updated successfully.")
 
 	case "view":
-		message, err := Database.ViewSystemMessage(m.GuildID)
+		message, err := b.db.ViewSystemMessage(ctx, m.GuildID)
 		if err != nil {
-			log.Printf("Error viewing system message for guild %s: %v", m.GuildID, err)
-			s.ChannelMessageSend(m.ChannelID, "An error occurred while retrieving the system message.")
+			b.reportError(s, m, "viewing system message", err)
 			return
 		}
 
@@ -393,7 +606,7 @@ func handleSystemMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
 		s.ChannelMessageSend(m.ChannelID, displayMessage)
 	}
 }
-func handleAPI(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (b *Bot) handleAPI(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	if m.Author.ID == s.State.User.ID {
 		return
 	}
@@ -412,19 +625,10 @@ func handleAPI(s *discordgo.Session, m *discordgo.MessageCreate) {
 
 	subcommand := parts[1]
 
-	// Check for 'Manage Server' permission for any command that modifies data
+	// Check for the manage_keys capability for any command that modifies data
 	isModifyingCommand := subcommand == "add" || subcommand == "remove" || subcommand == "clear"
-	if isModifyingCommand {
-		perms, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
-		if err != nil {
-			log.Printf("Error getting user permissions for %s: %v", m.Author.ID, err)
-			s.ChannelMessageSend(m.ChannelID, "Could not verify your permissions. Please try again.")
-			return
-		}
-		if perms&discordgo.PermissionManageGuild == 0 {
-			s.ChannelMessageSend(m.ChannelID, "You need the `Manage Server` permission to modify API keys.")
-			return
-		}
+	if isModifyingCommand && !b.requireCapability(ctx, s, m, Permissions.ManageKeys, "modify API keys") {
+		return
 	}
 
 	switch subcommand {
@@ -446,17 +650,16 @@ func handleAPI(s *discordgo.Session, m *discordgo.MessageCreate) {
 			},
 		})
 		if err != nil {
-			log.Printf("Error sending API key button: %v", err)
+			slog.Error("Error sending API key button", "err", err)
 		}
 		// The rest of the logic is now handled by the interaction handler below.
 		return
 
 	case "view":
 		// Note: This relies on the new ViewAPIKeys function suggested below.
-		keys, err := Database.ViewAPIKeys(m.GuildID)
+		keys, err := b.db.ViewAPIKeys(ctx, m.GuildID)
 		if err != nil {
-			log.Printf("Error viewing API keys for guild %s: %v", m.GuildID, err)
-			s.ChannelMessageSend(m.ChannelID, "An error occurred while retrieving API keys.")
+			b.reportError(s, m, "viewing API keys", err)
 			return
 		}
 
@@ -497,23 +700,29 @@ func handleAPI(s *discordgo.Session, m *discordgo.MessageCreate) {
 			return
 		}
 		apiKeyToRemove := parts[2]
+		before := Audit.Take(ctx, b.db, m.GuildID)
 		// Note: This relies on the new RemoveAPIKey function suggested below.
-		err := Database.RemoveAPIKey(m.GuildID, apiKeyToRemove)
+		err := b.db.RemoveAPIKey(ctx, m.GuildID, apiKeyToRemove)
+		if errors.Is(err, Database.ErrAPIKeyNotFound) {
+			s.ChannelMessageSend(m.ChannelID, "That key isn't on this server. Make sure you provided the exact key to remove.")
+			return
+		}
 		if err != nil {
-			log.Printf("Error removing API key for guild %s: %v", m.GuildID, err)
-			s.ChannelMessageSend(m.ChannelID, "An error occurred. Make sure you provided the exact key to remove.")
+			b.reportError(s, m, "removing API key", err)
 			return
 		}
+		b.auditChange(ctx, m.GuildID, m.Author, "api.remove", before)
 		s.ChannelMessageSend(m.ChannelID, "✅ API key has been removed successfully.")
 
 	case "clear":
+		before := Audit.Take(ctx, b.db, m.GuildID)
 		// Note: This relies on the new ClearAPIKeys function suggested below.
-		err := Database.ClearAPIKeys(m.GuildID)
+		err := b.db.ClearAPIKeys(ctx, m.GuildID)
 		if err != nil {
-			log.Printf("Error clearing API keys for guild %s: %v", m.GuildID, err)
-			s.ChannelMessageSend(m.ChannelID, "An error occurred while clearing API keys.")
+			b.reportError(s, m, "clearing API keys", err)
 			return
 		}
+		b.auditChange(ctx, m.GuildID, m.Author, "api.clear", before)
 		s.ChannelMessageSend(m.ChannelID, "✅ All API keys for this server have been cleared.")
 
 	default:
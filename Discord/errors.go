@@ -0,0 +1,61 @@
+package Discord
+
+import (
+	"context"
+	"fmt"
+	"hellish/Logging"
+	"hellish/Permissions"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// reportError logs an internal error under a reference ID and tells the channel
+// something went wrong, without the details. Admins can look the reference up
+// with !ref.
+func (b *Bot) reportError(s *discordgo.Session, m *discordgo.MessageCreate, action string, err error) {
+	s.ChannelMessageSend(m.ChannelID, Logging.UserError(m.GuildID, action, err))
+}
+
+// handleRef looks up an error reference from a user-facing error message.
+// Only errors from the same server are shown.
+func (b *Bot) handleRef(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author.ID == s.State.User.ID {
+		return
+	}
+	parts := strings.Fields(m.Content)
+	if len(parts) == 0 || parts[0] != prefix+"ref" {
+		return
+	}
+	if !b.requireCapability(ctx, s, m, Permissions.ViewAudit, "look up error references") {
+		return
+	}
+	if len(parts) < 2 {
+		s.ChannelMessageSend(m.ChannelID, "Usage: `!ref <reference>`")
+		return
+	}
+
+	// The reference is echoed in inline code, so it must not contain backticks.
+	ref := strings.ReplaceAll(parts[1], "`", "")
+	record, ok := Logging.Lookup(ref)
+	if !ok || record.GuildID != m.GuildID {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("No recent error with reference `%s` on this server. Only the most recent errors since the bot last started are kept.", ref))
+		return
+	}
+
+	// Backticks would end the code block the error is shown in.
+	errText := strings.ReplaceAll(record.Error, "`", "'")
+	if runes := []rune(errText); len(runes) > 1000 {
+		errText = string(runes[:1000]) + "..."
+	}
+	embed := &discordgo.MessageEmbed{
+		Title: "Error " + record.Ref,
+		Color: 0xED4245,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "While", Value: record.Action, Inline: true},
+			{Name: "When", Value: fmt.Sprintf("<t:%d:R>", record.Time.Unix()), Inline: true},
+			{Name: "Error", Value: "```" + errText + "```"},
+		},
+	}
+	s.ChannelMessageSendEmbed(m.ChannelID, embed)
+}
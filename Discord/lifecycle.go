@@ -0,0 +1,182 @@
+package Discord
+
+import (
+	"context"
+	"hellish/Tracing"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultDrainTimeout bounds how long shutdown waits for handlers that are
+// still running, such as replies waiting on Gemini.
+const defaultDrainTimeout = 20 * time.Second
+
+// handlerTimeout bounds a single handler run, including every Gemini and
+// database call it makes.
+const handlerTimeout = 2 * time.Minute
+
+// lifecycle tracks running handlers so shutdown can stop taking new events and
+// wait for the rest. Handler contexts derive from base, which is cancelled once
+// draining is over, and those handling a message are also cancelled when the
+// message is deleted.
+type lifecycle struct {
+	mu       sync.Mutex
+	closing  bool
+	inFlight sync.WaitGroup
+	base     context.Context
+	cancel   context.CancelFunc
+	messages map[string]*pendingMessage
+}
+
+// pendingMessage is the context shared by the handlers working on one message.
+// Its span is the root of the message's trace.
+type pendingMessage struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	span   trace.Span
+	refs   int
+}
+
+func newLifecycle() *lifecycle {
+	base, cancel := context.WithCancel(context.Background())
+	return &lifecycle{base: base, cancel: cancel, messages: map[string]*pendingMessage{}}
+}
+
+// begin registers a handler run. It returns false once shutdown has started.
+func (l *lifecycle) begin() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return false
+	}
+	l.inFlight.Add(1)
+	return true
+}
+
+// drain stops new handler runs and waits up to timeout for running ones. It
+// reports whether they all finished.
+func (l *lifecycle) drain(timeout time.Duration) bool {
+	l.mu.Lock()
+	l.closing = true
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.inFlight.Wait()
+		close(done)
+	}()
+	defer l.cancel()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// acquire returns the context for handling a message, shared with the other
+// handlers of the same message. Call release when done with it.
+func (l *lifecycle) acquire(m *discordgo.MessageCreate) context.Context {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pending, ok := l.messages[m.ID]
+	if !ok {
+		ctx, cancel := context.WithTimeout(l.base, handlerTimeout)
+		ctx, span := Tracing.Start(ctx, "discord.message_create",
+			attribute.String("discord.guild_id", m.GuildID),
+			attribute.String("discord.channel_id", m.ChannelID),
+			attribute.String("discord.message_id", m.ID),
+			attribute.String("discord.command", commandName(m)),
+		)
+		pending = &pendingMessage{ctx: ctx, cancel: cancel, span: span}
+		l.messages[m.ID] = pending
+	}
+	pending.refs++
+	return pending.ctx
+}
+
+// release drops a reference taken by acquire.
+func (l *lifecycle) release(messageID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pending, ok := l.messages[messageID]
+	if !ok {
+		return
+	}
+	pending.refs--
+	if pending.refs == 0 {
+		pending.span.End()
+		pending.cancel()
+		delete(l.messages, messageID)
+	}
+}
+
+// abandon cancels the work on deleted messages, e.g. a reply still waiting on
+// Gemini. Handlers see the cancellation through their context.
+func (l *lifecycle) abandon(messageIDs ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range messageIDs {
+		if pending, ok := l.messages[id]; ok {
+			slog.Debug("Message deleted, cancelling its handlers", "message", id)
+			pending.span.AddEvent("message deleted")
+			pending.cancel()
+		}
+	}
+}
+
+// context returns the context for one handler run. Message events share a
+// context per message ID so deleting the message cancels all of them.
+func (l *lifecycle) context(event any) (context.Context, context.CancelFunc) {
+	if m, ok := event.(*discordgo.MessageCreate); ok {
+		ctx := l.acquire(m)
+		return ctx, func() { l.release(m.ID) }
+	}
+	ctx, cancel := context.WithTimeout(l.base, handlerTimeout)
+	if i, ok := event.(*discordgo.InteractionCreate); ok {
+		var span trace.Span
+		ctx, span = Tracing.Start(ctx, "discord.interaction_create",
+			attribute.String("discord.guild_id", i.GuildID),
+			attribute.String("discord.interaction_type", i.Type.String()),
+		)
+		return ctx, func() {
+			span.End()
+			cancel()
+		}
+	}
+	return ctx, cancel
+}
+
+// guard wraps an event handler so it is tracked, skipped once shutdown has
+// started, and given a context that is cancelled when shutdown gives up on it.
+func guard[T any](l *lifecycle, handler func(context.Context, *discordgo.Session, T)) func(*discordgo.Session, T) {
+	return func(s *discordgo.Session, event T) {
+		if !l.begin() {
+			return
+		}
+		defer l.inFlight.Done()
+		ctx, done := l.context(event)
+		defer done()
+		handler(ctx, s, event)
+	}
+}
+
+// drainTimeout reads SHUTDOWN_TIMEOUT, e.g. "30s".
+func drainTimeout() time.Duration {
+	value := os.Getenv("SHUTDOWN_TIMEOUT")
+	if value == "" {
+		return defaultDrainTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid SHUTDOWN_TIMEOUT, using the default", "value", value, "default", defaultDrainTimeout)
+		return defaultDrainTimeout
+	}
+	return timeout
+}
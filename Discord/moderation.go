@@ -0,0 +1,288 @@
+package Discord
+
+import (
+	"context"
+	"fmt"
+	"hellish/Audit"
+	"hellish/Database"
+	"hellish/Moderation"
+	"hellish/Permissions"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// isNSFW reports whether a channel is marked as age-restricted.
+func isNSFW(s *discordgo.Session, channelID string) bool {
+	channel, err := s.State.Channel(channelID)
+	if err != nil {
+		channel, err = s.Channel(channelID)
+		if err != nil {
+			return false
+		}
+	}
+	return channel.NSFW
+}
+
+// withholdReply posts an in-character refusal instead of a blocked reply and
+// records the incident for the server's admins.
+func (b *Bot) withholdReply(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate, verdict Moderation.Verdict, text string) {
+	slog.Info("Withheld reply", "guild", m.GuildID, "channel", m.ChannelID, "source", verdict.Source, "reason", verdict.Reason)
+	// Without settings the refusal still goes out under the default policy.
+	settings, settingsErr := b.db.ViewModeration(ctx, m.GuildID)
+	if err := b.sendReply(ctx, s, m, Moderation.Refusal(), settings.Output); err != nil {
+		slog.Error("Error sending refusal", "guild", m.GuildID, "err", err)
+	}
+
+	excerpt := text
+	if len(excerpt) > 200 {
+		excerpt = excerpt[:200] + "..."
+	}
+	err := b.db.InsertIncident(ctx, Database.Incident{
+		ServerId:  m.GuildID,
+		ChannelId: m.ChannelID,
+		UserId:    m.Author.ID,
+		Source:    verdict.Source,
+		Reason:    verdict.Reason,
+		Excerpt:   excerpt,
+	})
+	if err != nil {
+		slog.Error("Error recording moderation incident", "guild", m.GuildID, "err", err)
+	}
+
+	if settingsErr != nil || settings.LogChannel == "" {
+		return
+	}
+	embed := &discordgo.MessageEmbed{
+		Title: "🛡️ Reply Withheld",
+		Color: 0xED4245, // Discord red
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Channel", Value: "<#" + m.ChannelID + ">", Inline: true},
+			{Name: "Requested by", Value: "<@" + m.Author.ID + ">", Inline: true},
+			{Name: "Source", Value: verdict.Source, Inline: true},
+			{Name: "Reason", Value: verdict.Reason},
+		},
+	}
+	if excerpt != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Excerpt", Value: "||" + Moderation.EscapeMarkdown(excerpt) + "||"})
+	}
+	if _, err := s.ChannelMessageSendEmbed(settings.LogChannel, embed); err != nil {
+		slog.Error("Error sending moderation incident to log channel", "guild", m.GuildID, "err", err)
+	}
+}
+
+func (b *Bot) handleModeration(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author.ID == s.State.User.ID {
+		return
+	}
+
+	// We only care about messages starting with "!moderation"
+	if !strings.HasPrefix(m.Content, prefix+"moderation") {
+		return
+	}
+
+	usage := "Usage: `!moderation <view|word|pattern|classifier|log|mentions|invites|links|emoji|markdown> [args]`"
+	parts := strings.Fields(m.Content)
+	if len(parts) < 2 {
+		s.ChannelMessageSend(m.ChannelID, usage)
+		return
+	}
+
+	subcommand := parts[1]
+
+	// Everything except viewing changes the server's settings.
+	if subcommand != "view" && !b.requireCapability(ctx, s, m, Permissions.ManageModeration, "change moderation settings") {
+		return
+	}
+
+	switch subcommand {
+	case "view":
+		settings, err := b.db.ViewModeration(ctx, m.GuildID)
+		if err != nil {
+			b.reportError(s, m, "viewing moderation settings", err)
+			return
+		}
+
+		logChannel := "Not set"
+		if settings.LogChannel != "" {
+			logChannel = "<#" + settings.LogChannel + ">"
+		}
+		classifier := "Off"
+		if settings.Classifier {
+			classifier = "On"
+		}
+		embed := &discordgo.MessageEmbed{
+			Title: "🛡️ Moderation Settings",
+			Color: 0x5865F2,
+			Fields: []*discordgo.MessageEmbedField{
+				{Name: "Blocked Words", Value: listOrNone(settings.BlockedWords, "||")},
+				{Name: "Blocked Patterns", Value: listOrNone(settings.BlockedPatterns, "`")},
+				{Name: "Classifier", Value: classifier, Inline: true},
+				{Name: "Log Channel", Value: logChannel, Inline: true},
+				{Name: "Reply Output", Value: describeOutput(settings.Output)},
+			},
+		}
+		s.ChannelMessageSendEmbed(m.ChannelID, embed)
+
+	case "word", "pattern":
+		if len(parts) < 4 || (parts[2] != "add" && parts[2] != "remove") {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Usage: `!moderation %s <add|remove> <%s>`", subcommand, subcommand))
+			return
+		}
+		value := strings.Join(parts[3:], " ")
+		if subcommand == "pattern" && parts[2] == "add" {
+			if err := Moderation.ValidatePattern(value); err != nil {
+				s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("That is not a valid regular expression: `%v`", err))
+				return
+			}
+		}
+
+		before := Audit.Take(ctx, b.db, m.GuildID)
+		var err error
+		switch {
+		case subcommand == "word" && parts[2] == "add":
+			err = b.db.AddBlockedWord(ctx, m.GuildID, value)
+		case subcommand == "word":
+			err = b.db.RemoveBlockedWord(ctx, m.GuildID, value)
+		case parts[2] == "add":
+			err = b.db.AddBlockedPattern(ctx, m.GuildID, value)
+		default:
+			err = b.db.RemoveBlockedPattern(ctx, m.GuildID, value)
+		}
+		if err != nil {
+			b.reportError(s, m, "updating blocked "+subcommand+"s", err)
+			return
+		}
+		b.auditChange(ctx, m.GuildID, m.Author, "moderation."+subcommand+"."+parts[2], before)
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ Blocked %s list has been updated.", subcommand))
+
+	case "classifier":
+		if len(parts) < 3 || (parts[2] != "on" && parts[2] != "off") {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!moderation classifier <on|off>`")
+			return
+		}
+		before := Audit.Take(ctx, b.db, m.GuildID)
+		if err := b.db.SetClassifier(ctx, m.GuildID, parts[2] == "on"); err != nil {
+			b.reportError(s, m, "setting classifier", err)
+			return
+		}
+		b.auditChange(ctx, m.GuildID, m.Author, "moderation.classifier", before)
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ Second-pass classifier is now %s.", parts[2]))
+
+	case "log":
+		if len(parts) < 3 || (parts[2] != "here" && parts[2] != "off") {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!moderation log <here|off>`")
+			return
+		}
+		channelID := ""
+		if parts[2] == "here" {
+			channelID = m.ChannelID
+		}
+		before := Audit.Take(ctx, b.db, m.GuildID)
+		if err := b.db.SetModerationLogChannel(ctx, m.GuildID, channelID); err != nil {
+			b.reportError(s, m, "setting moderation log channel", err)
+			return
+		}
+		b.auditChange(ctx, m.GuildID, m.Author, "moderation.log", before)
+		if channelID == "" {
+			s.ChannelMessageSend(m.ChannelID, "✅ Moderation incidents will no longer be reported.")
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, "✅ Moderation incidents will be reported in this channel.")
+
+	case "mentions", "invites", "links", "emoji", "markdown":
+		field, value, ok := parseOutputSetting(subcommand, parts[2:])
+		if !ok {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `"+outputUsage[subcommand]+"`")
+			return
+		}
+		before := Audit.Take(ctx, b.db, m.GuildID)
+		if err := b.db.SetOutputPolicy(ctx, m.GuildID, field, value); err != nil {
+			b.reportError(s, m, "setting reply output policy", err)
+			return
+		}
+		b.auditChange(ctx, m.GuildID, m.Author, "moderation.output."+subcommand, before)
+		s.ChannelMessageSend(m.ChannelID, "✅ Reply output policy has been updated.")
+
+	default:
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unknown subcommand `%s`. %s", subcommand, usage))
+	}
+}
+
+var outputUsage = map[string]string{
+	"mentions": "!moderation mentions <none|author|users>",
+	"invites":  "!moderation invites <strip|allow>",
+	"links":    "!moderation links <neutralize|allow>",
+	"emoji":    "!moderation emoji <max|off>",
+	"markdown": "!moderation markdown <fix|raw>",
+}
+
+// parseOutputSetting turns an output policy subcommand into the policy field
+// and value to store.
+func parseOutputSetting(subcommand string, args []string) (field string, value any, ok bool) {
+	if len(args) != 1 {
+		return "", nil, false
+	}
+	arg := args[0]
+	switch subcommand {
+	case "mentions":
+		if arg != Moderation.MentionsNone && arg != Moderation.MentionsAuthor && arg != Moderation.MentionsUsers {
+			return "", nil, false
+		}
+		return "mentions", arg, true
+	case "invites":
+		return "allow_invites", arg == "allow", arg == "allow" || arg == "strip"
+	case "links":
+		return "allow_masked_links", arg == "allow", arg == "allow" || arg == "neutralize"
+	case "emoji":
+		if arg == "off" {
+			return "emoji_limit", -1, true
+		}
+		limit, err := strconv.Atoi(arg)
+		if err != nil || limit < 1 {
+			return "", nil, false
+		}
+		return "emoji_limit", limit, true
+	case "markdown":
+		return "raw_markdown", arg == "raw", arg == "raw" || arg == "fix"
+	}
+	return "", nil, false
+}
+
+// describeOutput summarizes an output policy for the settings embed.
+func describeOutput(policy Database.OutputPolicy) string {
+	mentions := map[string]string{
+		Moderation.MentionsNone:   "pings nobody",
+		Moderation.MentionsAuthor: "pings only the user it answers",
+		Moderation.MentionsUsers:  "may ping any user",
+	}[Moderation.MentionPolicy(policy)]
+	invites, links, markdown := "Invites removed", "Masked links show their target", "Unclosed code blocks closed"
+	if policy.AllowInvites {
+		invites = "Invites allowed"
+	}
+	if policy.AllowMaskedLinks {
+		links = "Masked links allowed"
+	}
+	if policy.RawMarkdown {
+		markdown = "Markdown posted as written"
+	}
+	emoji := "No emoji limit"
+	if limit := Moderation.EmojiLimit(policy); limit >= 0 {
+		emoji = fmt.Sprintf("At most %d emoji", limit)
+	}
+	return fmt.Sprintf("Replies %s\n%s\n%s\n%s\n%s", mentions, invites, links, emoji, markdown)
+}
+
+// listOrNone formats a list for an embed field, wrapping each entry in the given markup.
+func listOrNone(values []string, wrap string) string {
+	if len(values) == 0 {
+		return "None"
+	}
+	var list strings.Builder
+	for _, value := range values {
+		list.WriteString(fmt.Sprintf("• %s%s%s\n", wrap, value, wrap))
+	}
+	return list.String()
+}
@@ -0,0 +1,192 @@
+package Discord
+
+import (
+	"context"
+	"fmt"
+	"hellish/Audit"
+	"hellish/Permissions"
+	"log/slog"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// hasCapability checks whether a member has a capability in the given channel.
+// The member may be nil, in which case only user grants and Discord permissions count.
+func (b *Bot) hasCapability(ctx context.Context, s *discordgo.Session, guildID, channelID string, user *discordgo.User, member *discordgo.Member, capability string) (bool, error) {
+	perms, err := s.UserChannelPermissions(user.ID, channelID)
+	if err != nil {
+		return false, fmt.Errorf("could not get channel permissions: %w", err)
+	}
+	config, err := b.db.ViewServer(ctx, guildID)
+	if err != nil {
+		return false, err
+	}
+
+	var roles []string
+	if member != nil {
+		roles = member.Roles
+	}
+	return Permissions.Allowed(config.Permissions, capability, user.ID, roles, perms), nil
+}
+
+// requireCapability checks a capability for the author of a command and tells them
+// if they lack it. The action completes the sentence "You need ... to <action>."
+func (b *Bot) requireCapability(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate, capability, action string) bool {
+	allowed, err := b.hasCapability(ctx, s, m.GuildID, m.ChannelID, m.Author, m.Member, capability)
+	if err != nil {
+		slog.Error("Error checking capability", "capability", capability, "user", m.Author.ID, "err", err)
+		s.ChannelMessageSend(m.ChannelID, "Could not verify your permissions. Please try again.")
+		return false
+	}
+	if !allowed {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("You need the `%s` capability to %s.", capability, action))
+		return false
+	}
+	return true
+}
+
+// requireInteractionCapability is requireCapability for component and modal interactions.
+func (b *Bot) requireInteractionCapability(ctx context.Context, s *discordgo.Session, i *discordgo.InteractionCreate, capability, action string) bool {
+	if i.Member == nil {
+		respondEphemeral(s, i, "This can only be used in a server.")
+		return false
+	}
+	allowed, err := b.hasCapability(ctx, s, i.GuildID, i.ChannelID, i.Member.User, i.Member, capability)
+	if err != nil {
+		slog.Error("Error checking capability", "capability", capability, "user", i.Member.User.ID, "err", err)
+		respondEphemeral(s, i, "Could not verify your permissions. Please try again.")
+		return false
+	}
+	if !allowed {
+		respondEphemeral(s, i, fmt.Sprintf("You need the `%s` capability to %s.", capability, action))
+		return false
+	}
+	return true
+}
+
+func (b *Bot) handlePerms(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author.ID == s.State.User.ID {
+		return
+	}
+
+	// We only care about messages starting with "!perms"
+	if !strings.HasPrefix(m.Content, prefix+"perms") {
+		return
+	}
+
+	usage := "Usage: `!perms <list|grant|revoke> [capability] [@role|@user]`"
+	parts := strings.Fields(m.Content)
+	if len(parts) < 2 {
+		s.ChannelMessageSend(m.ChannelID, usage)
+		return
+	}
+
+	// Granting capabilities is reserved for Manage Server so it can't be delegated away.
+	perms, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		slog.Error("Error getting user permissions", "user", m.Author.ID, "err", err)
+		s.ChannelMessageSend(m.ChannelID, "Could not verify your permissions. Please try again.")
+		return
+	}
+	if perms&discordgo.PermissionManageGuild == 0 {
+		s.ChannelMessageSend(m.ChannelID, "You need the `Manage Server` permission to manage bot permissions.")
+		return
+	}
+
+	subcommand := parts[1]
+
+	switch subcommand {
+	case "list":
+		config, err := b.db.ViewServer(ctx, m.GuildID)
+		if err != nil {
+			b.reportError(s, m, "viewing permissions", err)
+			return
+		}
+
+		embed := &discordgo.MessageEmbed{
+			Title:       "🔐 Bot Permissions",
+			Description: "Members with `Manage Server` always have every capability.",
+			Color:       0x5865F2,
+		}
+		for _, c := range Permissions.Capabilities {
+			var holders []string
+			grant := config.Permissions[c.Name]
+			for _, id := range grant.Roles {
+				holders = append(holders, "<@&"+id+">")
+			}
+			for _, id := range grant.Users {
+				holders = append(holders, "<@"+id+">")
+			}
+			value := strings.Join(holders, ", ")
+			if value == "" {
+				value = "Default: " + defaultHolders(c)
+			}
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+				Name:  fmt.Sprintf("`%s` — %s", c.Name, c.Description),
+				Value: value,
+			})
+		}
+		s.ChannelMessageSendEmbed(m.ChannelID, embed)
+
+	case "grant", "revoke":
+		if len(parts) < 4 {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Usage: `!perms %s <capability> <@role|@user>`", subcommand))
+			return
+		}
+		if _, ok := Permissions.Lookup(parts[2]); !ok {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unknown capability `%s`. Use `!perms list` to see them all.", parts[2]))
+			return
+		}
+		kind, id, ok := parseMention(parts[3])
+		if !ok {
+			s.ChannelMessageSend(m.ChannelID, "Please mention a role or a user.")
+			return
+		}
+
+		before := Audit.Take(ctx, b.db, m.GuildID)
+		if subcommand == "grant" {
+			err = b.db.GrantCapability(ctx, m.GuildID, parts[2], kind, id)
+		} else {
+			err = b.db.RevokeCapability(ctx, m.GuildID, parts[2], kind, id)
+		}
+		if err != nil {
+			b.reportError(s, m, "updating permissions", err)
+			return
+		}
+		b.auditChange(ctx, m.GuildID, m.Author, "perms."+subcommand, before)
+
+		if subcommand == "grant" {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ Granted `%s` to %s.", parts[2], parts[3]))
+		} else {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ Revoked `%s` from %s.", parts[2], parts[3]))
+		}
+
+	default:
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unknown subcommand `%s`. %s", subcommand, usage))
+	}
+}
+
+// parseMention turns a role or user mention into the grant kind and ID.
+func parseMention(mention string) (kind string, id string, ok bool) {
+	if !strings.HasPrefix(mention, "<@") || !strings.HasSuffix(mention, ">") {
+		return "", "", false
+	}
+	inner := strings.TrimSuffix(strings.TrimPrefix(mention, "<@"), ">")
+	if strings.HasPrefix(inner, "&") {
+		return "roles", inner[1:], inner != "&"
+	}
+	inner = strings.TrimPrefix(inner, "!")
+	return "users", inner, inner != ""
+}
+
+func defaultHolders(c Permissions.Capability) string {
+	switch c.Default {
+	case 0:
+		return "everyone"
+	case discordgo.PermissionManageMessages:
+		return "`Manage Messages`"
+	default:
+		return "`Manage Server`"
+	}
+}
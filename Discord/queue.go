@@ -0,0 +1,346 @@
+package Discord
+
+import (
+	"context"
+	"hellish/Metrics"
+	"hellish/Tracing"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultChatWorkers    = 8
+	defaultChatQueueLimit = 10
+	defaultChatDebounce   = 1500 * time.Millisecond
+	// A user who keeps typing is answered after at most this many windows.
+	maxDebounceWindows = 5
+)
+
+// chatQueue answers chat messages one turn at a time per channel, so replies
+// come out in the order the messages arrived. Messages that pile up from the
+// same user while an earlier reply is generating are answered together, and
+// only a bounded number of channels generate at once.
+type chatQueue struct {
+	bot     *Bot
+	workers chan struct{}
+	// limit bounds how many messages may wait in one channel.
+	limit int
+	// lease makes replicas sharing a database take a lease on a channel before
+	// answering in it, so two of them never both reply.
+	lease bool
+	// debounce is how long a user must stay quiet before their turn is
+	// answered, so a thought typed across several messages becomes one turn.
+	debounce time.Duration
+
+	mu       sync.Mutex
+	channels map[string]*channelQueue
+}
+
+// channelQueue holds the messages waiting in one channel.
+type channelQueue struct {
+	pending []*chatJob
+}
+
+// chatJob is one message waiting for a reply. done is closed once it has been
+// answered, on its own or as part of a turn.
+type chatJob struct {
+	ctx     context.Context
+	s       *discordgo.Session
+	m       *discordgo.MessageCreate
+	arrived time.Time
+	done    chan struct{}
+}
+
+// newChatQueue reads CHAT_WORKERS, CHAT_QUEUE_LIMIT, CHAT_CHANNEL_LEASE and
+// CHAT_DEBOUNCE.
+func newChatQueue(b *Bot) *chatQueue {
+	q := &chatQueue{
+		bot:      b,
+		workers:  make(chan struct{}, envInt("CHAT_WORKERS", defaultChatWorkers)),
+		limit:    envInt("CHAT_QUEUE_LIMIT", defaultChatQueueLimit),
+		lease:    os.Getenv("CHAT_CHANNEL_LEASE") == "true",
+		debounce: envDuration("CHAT_DEBOUNCE", defaultChatDebounce),
+		channels: map[string]*channelQueue{},
+	}
+	activeQueue.Store(q)
+	return q
+}
+
+// activeQueue is the queue the gauges below report on, the one created last.
+// The gauges are registered once, since a metric can't be registered twice.
+var activeQueue atomic.Pointer[chatQueue]
+
+var (
+	_ = Metrics.NewGaugeFunc("hellish_chat_queue_depth", "Chat messages waiting for a reply, across all channels.", func() float64 {
+		if q := activeQueue.Load(); q != nil {
+			return q.depth()
+		}
+		return 0
+	})
+	_ = Metrics.NewGaugeFunc("hellish_chat_workers_busy", "Channels generating a reply right now.", func() float64 {
+		if q := activeQueue.Load(); q != nil {
+			return float64(len(q.workers))
+		}
+		return 0
+	})
+)
+
+// depth counts the messages waiting in every channel.
+func (q *chatQueue) depth() float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, channel := range q.channels {
+		n += len(channel.pending)
+	}
+	return float64(n)
+}
+
+// envInt reads a positive integer setting.
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		slog.Warn("Invalid "+name+", using the default", "value", value, "default", fallback)
+		return fallback
+	}
+	return n
+}
+
+// envDuration reads a duration setting such as "1.5s". Zero is allowed.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		slog.Warn("Invalid "+name+", using the default", "value", value, "default", fallback)
+		return fallback
+	}
+	return d
+}
+
+// submit queues a message and waits until it has been answered or ctx is done.
+func (q *chatQueue) submit(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	ctx, span := Tracing.Start(ctx, "chat.queue")
+	defer span.End()
+	job := &chatJob{ctx: ctx, s: s, m: m, arrived: time.Now(), done: make(chan struct{})}
+
+	q.mu.Lock()
+	channel, ok := q.channels[m.ChannelID]
+	if !ok {
+		channel = &channelQueue{}
+		q.channels[m.ChannelID] = channel
+		go q.run(m.ChannelID, channel)
+	}
+	if len(channel.pending) >= q.limit {
+		q.mu.Unlock()
+		slog.Warn("Chat queue full, ignoring message", "guild", m.GuildID, "channel", m.ChannelID, "limit", q.limit)
+		Metrics.QueueDropped.Inc()
+		span.AddEvent("queue full")
+		return
+	}
+	channel.pending = append(channel.pending, job)
+	span.SetAttributes(attribute.Int("chat.queue_position", len(channel.pending)))
+	q.mu.Unlock()
+
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+	}
+}
+
+// run answers a channel's messages until none are left.
+func (q *chatQueue) run(channelID string, channel *channelQueue) {
+	leased := false
+	defer func() {
+		if leased {
+			q.releaseLease(channelID)
+		}
+	}()
+
+	for {
+		q.settle(channelID, channel)
+		// Take the turn only once a worker is free, so it includes everything
+		// that arrived in the meantime.
+		q.workers <- struct{}{}
+		q.mu.Lock()
+		turn := channel.next()
+		if turn == nil {
+			delete(q.channels, channelID)
+			q.mu.Unlock()
+			<-q.workers
+			return
+		}
+		q.mu.Unlock()
+
+		ctx, cancel := q.turnContext(turn)
+		answer := true
+		if q.lease {
+			// Renewed every turn, since a busy channel can outlast one lease.
+			answer = q.acquireLease(ctx, channelID)
+			leased = leased || answer
+		}
+		if answer {
+			q.bot.reply(ctx, turn[0].s, messages(turn))
+		}
+		cancel()
+		<-q.workers
+
+		for _, job := range turn {
+			close(job.done)
+		}
+	}
+}
+
+// settle waits until the author of the next turn has stopped sending messages
+// for the debounce window, or someone else has spoken after them. The channel
+// shows the bot typing meanwhile.
+func (q *chatQueue) settle(channelID string, channel *channelQueue) {
+	if q.debounce == 0 {
+		return
+	}
+	// Typing lasts about ten seconds, so keep it up however many windows pass.
+	var stopTyping func()
+	defer func() {
+		if stopTyping != nil {
+			stopTyping()
+		}
+	}()
+	for {
+		q.mu.Lock()
+		first, last, closed := channel.head()
+		q.mu.Unlock()
+		if first == nil || closed {
+			return
+		}
+		deadline := last.arrived.Add(q.debounce)
+		if limit := first.arrived.Add(maxDebounceWindows * q.debounce); deadline.After(limit) {
+			deadline = limit
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return
+		}
+		if stopTyping == nil {
+			stopTyping = keepTyping(q.bot.lifecycle.base, first.s, channelID)
+		}
+		select {
+		case <-time.After(wait):
+		case <-q.bot.lifecycle.base.Done():
+			return
+		}
+	}
+}
+
+// head returns the first and last message of the next turn, and whether the
+// turn is closed because another author's message follows it.
+func (c *channelQueue) head() (first, last *chatJob, closed bool) {
+	if len(c.pending) == 0 {
+		return nil, nil, false
+	}
+	first, last = c.pending[0], c.pending[0]
+	for _, job := range c.pending[1:] {
+		if job.m.Author.ID != first.m.Author.ID {
+			return first, last, true
+		}
+		last = job
+	}
+	return first, last, false
+}
+
+// next removes and returns the next turn: the first waiting message and any
+// that directly follow it from the same author. Messages that were deleted in
+// the meantime are dropped.
+func (c *channelQueue) next() []*chatJob {
+	live := c.pending[:0]
+	for _, job := range c.pending {
+		if job.ctx.Err() != nil {
+			close(job.done)
+			continue
+		}
+		live = append(live, job)
+	}
+	c.pending = live
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	n := 1
+	for n < len(c.pending) && c.pending[n].m.Author.ID == c.pending[0].m.Author.ID {
+		n++
+	}
+	turn := append([]*chatJob(nil), c.pending[:n]...)
+	c.pending = append(c.pending[:0], c.pending[n:]...)
+	return turn
+}
+
+// turnContext returns a context for answering a turn. It is cancelled on
+// shutdown, or once every message in the turn has been deleted. The reply is
+// traced as part of the turn's last message.
+func (q *chatQueue) turnContext(turn []*chatJob) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(q.bot.lifecycle.base, handlerTimeout)
+	ctx = trace.ContextWithSpanContext(ctx, trace.SpanContextFromContext(turn[len(turn)-1].ctx))
+	remaining := int32(len(turn))
+	stops := make([]func() bool, 0, len(turn))
+	for _, job := range turn {
+		stops = append(stops, context.AfterFunc(job.ctx, func() {
+			if atomic.AddInt32(&remaining, -1) == 0 {
+				cancel()
+			}
+		}))
+	}
+	return ctx, func() {
+		for _, stop := range stops {
+			stop()
+		}
+		cancel()
+	}
+}
+
+func channelLease(channelID string) string {
+	return "channel:" + channelID
+}
+
+// acquireLease takes the channel's lease for this process. If the database
+// can't be reached we answer anyway rather than leave the channel silent.
+func (q *chatQueue) acquireLease(ctx context.Context, channelID string) bool {
+	ok, err := q.bot.db.AcquireLease(ctx, channelLease(channelID), instanceID, handlerTimeout)
+	if err != nil {
+		slog.Warn("Could not take channel lease, answering anyway", "channel", channelID, "err", err)
+		return true
+	}
+	if !ok {
+		slog.Debug("Another replica is answering in this channel", "channel", channelID)
+	}
+	return ok
+}
+
+func (q *chatQueue) releaseLease(channelID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.bot.db.ReleaseLease(ctx, channelLease(channelID), instanceID); err != nil {
+		slog.Warn("Could not release channel lease", "channel", channelID, "err", err)
+	}
+}
+
+// messages returns the messages of a turn.
+func messages(turn []*chatJob) []*discordgo.MessageCreate {
+	ms := make([]*discordgo.MessageCreate, len(turn))
+	for i, job := range turn {
+		ms[i] = job.m
+	}
+	return ms
+}
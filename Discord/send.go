@@ -0,0 +1,81 @@
+package Discord
+
+import (
+	"context"
+	"hellish/Database"
+	"hellish/Moderation"
+	"hellish/Tracing"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// typingInterval refreshes the typing indicator before Discord's ten seconds
+// run out.
+const typingInterval = 8 * time.Second
+
+// keepTyping shows the bot typing in a channel until stop is called or ctx is
+// done. Sending a message also clears the indicator, so call stop first.
+func keepTyping(ctx context.Context, s *discordgo.Session, channelID string) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(typingInterval)
+		defer ticker.Stop()
+		for {
+			if err := s.ChannelTyping(channelID); err != nil {
+				slog.Debug("Could not show typing indicator", "channel", channelID, "err", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// maxMessageLength is the most Discord accepts in one message.
+const maxMessageLength = 2000
+
+// sendReply posts text the AI wrote in answer to m. It is sent as a reply to m
+// unless CHAT_REPLY_REFERENCE is off. It may only ping whom the server's output
+// policy allows, so the model can never reach @everyone, @here or roles.
+func (b *Bot) sendReply(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate, text string, policy Database.OutputPolicy) error {
+	_, span := Tracing.Start(ctx, "discord.send", attribute.String("discord.channel_id", m.ChannelID))
+	if runes := []rune(text); len(runes) > maxMessageLength {
+		text = string(runes[:maxMessageLength-3]) + "..."
+	}
+	send := &discordgo.MessageSend{Content: text, AllowedMentions: allowedMentions(m, policy)}
+	if b.replyReference {
+		// A soft reference still posts if the message was deleted meanwhile.
+		send.Reference = m.SoftReference()
+	}
+	_, err := s.ChannelMessageSendComplex(m.ChannelID, send)
+	Tracing.End(span, err)
+	return err
+}
+
+// allowedMentions turns a mention policy into what Discord may ping.
+func allowedMentions(m *discordgo.MessageCreate, policy Database.OutputPolicy) *discordgo.MessageAllowedMentions {
+	switch Moderation.MentionPolicy(policy) {
+	case Moderation.MentionsNone:
+		return &discordgo.MessageAllowedMentions{}
+	case Moderation.MentionsUsers:
+		return &discordgo.MessageAllowedMentions{
+			Parse:       []discordgo.AllowedMentionType{discordgo.AllowedMentionTypeUsers},
+			RepliedUser: true,
+		}
+	default:
+		return &discordgo.MessageAllowedMentions{Users: []string{m.Author.ID}, RepliedUser: true}
+	}
+}
@@ -0,0 +1,535 @@
+package Discord
+
+import (
+	"context"
+	"fmt"
+	"hellish/Database"
+	"hellish/Metrics"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// identifyInterval spaces out gateway logins; Discord allows one per five
+	// seconds per rate limit bucket.
+	identifyInterval = 5 * time.Second
+	// Shard leases are renewed well before they expire, so a process only
+	// loses its shards when it stops renewing them.
+	leaseTTL           = 30 * time.Second
+	leaseRenewInterval = 10 * time.Second
+	// orphanGrace is how long a coordinated process waits before it takes more
+	// than its share, so that processes starting together split shards evenly.
+	orphanGrace = 2 * leaseTTL
+)
+
+// shardConfig says which gateway shards this process runs.
+type shardConfig struct {
+	// count is the total number of shards; 0 means Discord's recommendation.
+	count int
+	// ids lists the shards to run; nil means all of them.
+	ids []int
+	// coordinated processes claim shards through leases in the database,
+	// each taking about count/processes of them.
+	coordinated bool
+	processes   int
+}
+
+// loadShardConfig reads SHARD_COUNT ("auto" or a number), SHARD_IDS ("auto",
+// or a list such as "0,2,4-7") and SHARD_PROCESSES.
+func loadShardConfig() (shardConfig, error) {
+	config := shardConfig{processes: 1}
+
+	if value := os.Getenv("SHARD_COUNT"); value != "" && value != "auto" {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 1 {
+			return config, fmt.Errorf("invalid SHARD_COUNT %q", value)
+		}
+		config.count = count
+	}
+
+	switch value := os.Getenv("SHARD_IDS"); value {
+	case "":
+	case "auto":
+		config.coordinated = true
+		if value := os.Getenv("SHARD_PROCESSES"); value != "" {
+			processes, err := strconv.Atoi(value)
+			if err != nil || processes < 1 {
+				return config, fmt.Errorf("invalid SHARD_PROCESSES %q", value)
+			}
+			config.processes = processes
+		}
+	default:
+		ids, err := parseShardIDs(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid SHARD_IDS: %w", err)
+		}
+		config.ids = ids
+	}
+	return config, nil
+}
+
+// parseShardIDs parses a comma-separated list of shard IDs and ranges.
+func parseShardIDs(value string) ([]int, error) {
+	seen := map[int]bool{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		low, high, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(low)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("%q is not a shard ID", part)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(high); err != nil || last < first {
+				return nil, fmt.Errorf("%q is not a shard range", part)
+			}
+		}
+		for id := first; id <= last; id++ {
+			seen[id] = true
+		}
+	}
+	ids := make([]int, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// ShardStatus describes the health of one gateway shard.
+type ShardStatus struct {
+	ID               int       `json:"id"`
+	State            string    `json:"state"`
+	Since            time.Time `json:"since"`
+	Guilds           int       `json:"guilds"`
+	Reconnects       int       `json:"reconnects"`
+	LastHeartbeatAck time.Time `json:"last_heartbeat_ack"`
+	Latency          string    `json:"latency"`
+}
+
+// shard is one gateway connection and what we know about its state.
+type shard struct {
+	id      int
+	session *discordgo.Session
+
+	mu         sync.Mutex
+	state      string
+	since      time.Time
+	reconnects int
+}
+
+func (sh *shard) setState(state string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if state == "connected" && !sh.since.IsZero() {
+		sh.reconnects++
+		Metrics.GatewayReconnects.Inc(strconv.Itoa(sh.id))
+	}
+	sh.state, sh.since = state, time.Now()
+}
+
+func (sh *shard) status() ShardStatus {
+	sh.mu.Lock()
+	status := ShardStatus{ID: sh.id, State: sh.state, Since: sh.since, Reconnects: sh.reconnects}
+	sh.mu.Unlock()
+
+	s := sh.session
+	s.RLock()
+	status.LastHeartbeatAck = s.LastHeartbeatAck
+	if !s.LastHeartbeatSent.IsZero() {
+		status.Latency = s.LastHeartbeatAck.Sub(s.LastHeartbeatSent).String()
+	}
+	s.RUnlock()
+	s.State.RLock()
+	status.Guilds = len(s.State.Guilds)
+	s.State.RUnlock()
+	return status
+}
+
+// shardManager opens, tracks and closes the shards this process runs.
+type shardManager struct {
+	bot   *Bot
+	token string
+	count int
+
+	mu           sync.Mutex
+	shards       map[int]*shard
+	lastIdentify time.Time
+	// identifyInterval divided by the bucket concurrency Discord reports.
+	identifyEvery time.Duration
+}
+
+func newShardManager(b *Bot, token string, count, maxConcurrency int) *shardManager {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	return &shardManager{
+		bot:           b,
+		token:         token,
+		count:         count,
+		shards:        map[int]*shard{},
+		identifyEvery: identifyInterval / time.Duration(maxConcurrency),
+	}
+}
+
+// recommendedShards asks Discord how many shards the bot should use and how
+// many may log in at once.
+func recommendedShards(token string) (count, maxConcurrency int, err error) {
+	sess, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return 0, 0, err
+	}
+	gateway, err := sess.GatewayBot()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get the recommended shard count: %w", err)
+	}
+	return gateway.Shards, gateway.SessionStartLimit.MaxConcurrency, nil
+}
+
+// start opens a shard's gateway session, waiting for the identify rate limit.
+func (m *shardManager) start(ctx context.Context, id int) error {
+	m.mu.Lock()
+	if _, running := m.shards[id]; running {
+		m.mu.Unlock()
+		return nil
+	}
+	wait := time.Until(m.lastIdentify.Add(m.identifyEvery))
+	m.lastIdentify = time.Now().Add(max(wait, 0))
+	m.mu.Unlock()
+
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	sess, err := discordgo.New("Bot " + m.token)
+	if err != nil {
+		return fmt.Errorf("failed to create Discord session: %w", err)
+	}
+	sess.ShardID, sess.ShardCount = id, m.count
+	sess.Identify.Intents = discordgo.IntentsAllWithoutPrivileged | discordgo.IntentsMessageContent
+
+	sh := &shard{id: id, session: sess, state: "connecting"}
+	m.bot.addHandlers(sess)
+	sess.AddHandler(func(s *discordgo.Session, _ *discordgo.Connect) { sh.setState("connected") })
+	sess.AddHandler(func(s *discordgo.Session, _ *discordgo.Disconnect) {
+		sh.setState("disconnected")
+		slog.Warn("Shard disconnected", "shard", id)
+	})
+	sess.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
+		sh.setState("ready")
+		slog.Info("Shard ready", "shard", id, "shards", m.count, "user", r.User.Username, "guilds", len(r.Guilds))
+	})
+	sess.AddHandler(func(s *discordgo.Session, _ *discordgo.Resumed) {
+		sh.setState("ready")
+		slog.Info("Shard resumed", "shard", id)
+	})
+
+	if err := sess.Open(); err != nil {
+		return fmt.Errorf("failed to connect shard %d: %w", id, err)
+	}
+	m.mu.Lock()
+	m.shards[id] = sh
+	m.mu.Unlock()
+	return nil
+}
+
+// stop closes a shard's gateway session.
+func (m *shardManager) stop(id int) {
+	m.mu.Lock()
+	sh, ok := m.shards[id]
+	delete(m.shards, id)
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := sh.session.Close(); err != nil {
+		slog.Error("Error closing shard", "shard", id, "err", err)
+	}
+}
+
+// running lists the IDs of the shards that are open.
+func (m *shardManager) running() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]int, 0, len(m.shards))
+	for id := range m.shards {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// stopAll closes every shard.
+func (m *shardManager) stopAll() {
+	for _, id := range m.running() {
+		m.stop(id)
+	}
+}
+
+// Health reports the state of every shard this process runs.
+func (m *shardManager) Health() []ShardStatus {
+	m.mu.Lock()
+	shards := make([]*shard, 0, len(m.shards))
+	for _, sh := range m.shards {
+		shards = append(shards, sh)
+	}
+	m.mu.Unlock()
+
+	statuses := make([]ShardStatus, 0, len(shards))
+	for _, sh := range shards {
+		statuses = append(statuses, sh.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// maxHeartbeatAge is how long a shard may go without a heartbeat ack, or stay
+// disconnected, before it counts as wedged. Discord asks for a heartbeat about
+// every 41 seconds and discordgo reconnects on its own well within this.
+const maxHeartbeatAge = 2 * time.Minute
+
+// checkHeartbeats fails when a shard is wedged: it stopped getting heartbeat
+// acks or hasn't managed to reconnect.
+func (m *shardManager) checkHeartbeats(context.Context) error {
+	for _, status := range m.Health() {
+		if status.State != "ready" {
+			if age := time.Since(status.Since); age > maxHeartbeatAge {
+				return fmt.Errorf("shard %d has been %s for %s", status.ID, status.State, age.Round(time.Second))
+			}
+			continue
+		}
+		if ack := status.LastHeartbeatAck; !ack.IsZero() && time.Since(ack) > maxHeartbeatAge {
+			return fmt.Errorf("shard %d got its last heartbeat ack %s ago", status.ID, time.Since(ack).Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// checkReady fails until every shard this process runs is ready.
+func (m *shardManager) checkReady(context.Context) error {
+	statuses := m.Health()
+	if len(statuses) == 0 {
+		return fmt.Errorf("no shards running")
+	}
+	for _, status := range statuses {
+		if status.State != "ready" {
+			return fmt.Errorf("shard %d is %s", status.ID, status.State)
+		}
+	}
+	return nil
+}
+
+// coordinator splits shards between processes sharing a database. Each shard
+// is held through a lease; a process renews the leases of its shards and
+// closes any shard whose lease another process took over.
+type coordinator struct {
+	manager *shardManager
+	db      *Database.DB
+	owner   string
+	share   int
+	started time.Time
+	done    chan struct{}
+	// pending feeds claimed shards to start, which opens them one at a time
+	// so the identify rate limit never holds up lease renewal.
+	pending chan int
+
+	mu sync.Mutex
+	// claimed holds the shards whose lease this process holds, whether they
+	// are running yet or still waiting to start.
+	claimed map[int]bool
+	// balanced is set after a balance pass that reached the database.
+	balanced bool
+}
+
+// instanceID identifies this process as the owner of leases.
+var instanceID = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}()
+
+func newCoordinator(m *shardManager, db *Database.DB, processes int) *coordinator {
+	return &coordinator{
+		manager: m,
+		db:      db,
+		owner:   instanceID,
+		share:   (m.count + processes - 1) / processes,
+		started: time.Now(),
+		done:    make(chan struct{}),
+		pending: make(chan int, m.count),
+		claimed: map[int]bool{},
+	}
+}
+
+func shardLease(id, count int) string {
+	return fmt.Sprintf("shard:%d/%d", id, count)
+}
+
+// run claims and renews shards until ctx is done. Shards stay open after it
+// returns; release closes them.
+func (c *coordinator) run(ctx context.Context) {
+	starter := make(chan struct{})
+	go func() {
+		defer close(starter)
+		c.start(ctx)
+	}()
+	defer func() {
+		close(c.pending)
+		<-starter
+		close(c.done)
+	}()
+
+	slog.Info("Coordinating shards", "owner", c.owner, "shards", c.manager.count, "share", c.share)
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+	for {
+		c.balance(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// balance renews the leases this process holds and claims free shards up to
+// its share. Once the startup grace period is over it also takes shards that
+// nobody holds, so the shards of a process that died keep running. Claimed
+// shards are opened by start, so this never waits on the identify rate limit.
+func (c *coordinator) balance(ctx context.Context) {
+	reached := true
+	for _, id := range c.claimedIDs() {
+		ok, err := c.db.AcquireLease(ctx, shardLease(id, c.manager.count), c.owner, leaseTTL)
+		if err != nil {
+			// Nobody else can claim the shard while the database is unreachable
+			// either, so keep it running.
+			slog.Warn("Could not renew shard lease", "shard", id, "err", err)
+			reached = false
+			continue
+		}
+		if !ok {
+			slog.Warn("Lost shard lease to another process, closing shard", "shard", id)
+			c.unclaim(id)
+			c.manager.stop(id)
+		}
+	}
+
+	overflow := time.Since(c.started) > orphanGrace
+	for id := 0; id < c.manager.count && ctx.Err() == nil; id++ {
+		c.mu.Lock()
+		skip := c.claimed[id] || (len(c.claimed) >= c.share && !overflow)
+		c.mu.Unlock()
+		if skip {
+			continue
+		}
+		ok, err := c.db.AcquireLease(ctx, shardLease(id, c.manager.count), c.owner, leaseTTL)
+		if err != nil {
+			slog.Warn("Could not claim shard lease", "shard", id, "err", err)
+			reached = false
+			break
+		}
+		if !ok {
+			continue
+		}
+		c.mu.Lock()
+		c.claimed[id] = true
+		c.mu.Unlock()
+		c.pending <- id
+	}
+
+	c.mu.Lock()
+	c.balanced = reached && ctx.Err() == nil
+	c.mu.Unlock()
+}
+
+// start opens claimed shards as they come in, until run closes pending.
+func (c *coordinator) start(ctx context.Context) {
+	for id := range c.pending {
+		if ctx.Err() != nil || !c.holds(id) {
+			continue
+		}
+		if err := c.manager.start(ctx, id); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Failed to start claimed shard", "shard", id, "err", err)
+				c.unclaim(id)
+				c.db.ReleaseLease(ctx, shardLease(id, c.manager.count), c.owner)
+			}
+			continue
+		}
+		if !c.holds(id) {
+			// The lease was lost while the shard was starting.
+			c.manager.stop(id)
+		}
+	}
+}
+
+func (c *coordinator) holds(id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.claimed[id]
+}
+
+func (c *coordinator) unclaim(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.claimed, id)
+}
+
+func (c *coordinator) claimedIDs() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]int, 0, len(c.claimed))
+	for id := range c.claimed {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// checkReady passes once a balance pass has reached the database and every
+// claimed shard is ready. Holding no shards is fine, e.g. for a spare process
+// when the others already run them all.
+func (c *coordinator) checkReady(context.Context) error {
+	c.mu.Lock()
+	balanced := c.balanced
+	c.mu.Unlock()
+	if !balanced {
+		return fmt.Errorf("shard leases not balanced yet")
+	}
+
+	states := map[int]string{}
+	for _, status := range c.manager.Health() {
+		states[status.ID] = status.State
+	}
+	for _, id := range c.claimedIDs() {
+		if state, ok := states[id]; !ok {
+			return fmt.Errorf("shard %d is starting", id)
+		} else if state != "ready" {
+			return fmt.Errorf("shard %d is %s", id, state)
+		}
+	}
+	return nil
+}
+
+// release closes this process's shards and hands their leases back, so other
+// processes don't have to wait for them to expire. It waits for run to return.
+func (c *coordinator) release() {
+	<-c.done
+	c.manager.stopAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, id := range c.claimedIDs() {
+		if err := c.db.ReleaseLease(ctx, shardLease(id, c.manager.count), c.owner); err != nil {
+			slog.Warn("Could not release shard lease", "shard", id, "err", err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Package Health serves liveness and readiness checks for container
+// orchestration. /healthz fails when the process is wedged and should be
+// restarted; /readyz also fails while it can't do its work, e.g. when the
+// database is unreachable.
+package Health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Check returns an error when the thing it checks is unhealthy.
+type Check func(ctx context.Context) error
+
+// checkTimeout bounds all the checks of one request.
+const checkTimeout = 5 * time.Second
+
+var (
+	mu    sync.Mutex
+	live  = map[string]Check{}
+	ready = map[string]Check{}
+)
+
+// Live registers a liveness check. Liveness checks are part of readiness too,
+// so names must not repeat between the two.
+func Live(name string, check Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	live[name] = check
+}
+
+// Ready registers a readiness check.
+func Ready(name string, check Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	ready[name] = check
+}
+
+// Report is the result of one set of checks.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Handler serves /healthz and /readyz. Both answer 200 when every check
+// passes and 503 otherwise, with the result of each check as JSON.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, run(r.Context(), false))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, run(r.Context(), true))
+	})
+	return mux
+}
+
+// run runs the liveness checks, and the readiness checks too if withReady is set.
+func run(ctx context.Context, withReady bool) Report {
+	mu.Lock()
+	checks := map[string]Check{}
+	for name, check := range live {
+		checks[name] = check
+	}
+	if withReady {
+		for name, check := range ready {
+			checks[name] = check
+		}
+	}
+	mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	report := Report{Status: "ok", Checks: map[string]string{}}
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := checks[name](ctx); err != nil {
+			report.Status = "fail"
+			report.Checks[name] = err.Error()
+			continue
+		}
+		report.Checks[name] = "ok"
+	}
+	return report
+}
+
+func respond(w http.ResponseWriter, report Report) {
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Debug("Error writing health report", "err", err)
+	}
+}
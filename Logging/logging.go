@@ -0,0 +1,103 @@
+package Logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Init installs a redacting slog handler as the default logger. The standard
+// log package writes through it too, so output from libraries such as
+// discordgo is redacted as well. LOG_LEVEL is debug, info, warn or error (default info);
+// LOG_FORMAT is text or json (default text).
+func Init() {
+	slog.SetDefault(slog.New(newHandler(os.Stderr)))
+}
+
+func newHandler(w io.Writer) slog.Handler {
+	level := slog.LevelInfo
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var inner slog.Handler
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "json" {
+		inner = slog.NewJSONHandler(w, options)
+	} else {
+		inner = slog.NewTextHandler(w, options)
+	}
+
+	// Values of these settings are never logged, wherever they turn up.
+	for _, name := range []string{"BOT_TOKEN", "ENCRYPTION_KEY", "ENCRYPTION_KEYS", "VAULT_TOKEN"} {
+		AddSecret(os.Getenv(name))
+	}
+	return &redactingHandler{inner: inner, logContent: os.Getenv("LOG_USER_CONTENT") == "true"}
+}
+
+// redactingHandler scrubs secrets from messages and attributes, and hides user
+// content unless LOG_USER_CONTENT is true, before passing records on.
+type redactingHandler struct {
+	inner      slog.Handler
+	logContent bool
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	scrubbed := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		scrubbed.AddAttrs(h.scrub(a))
+		return true
+	})
+	return h.inner.Handle(ctx, scrubbed)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	scrubbed := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		scrubbed[i] = h.scrub(a)
+	}
+	return &redactingHandler{inner: h.inner.WithAttrs(scrubbed), logContent: h.logContent}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{inner: h.inner.WithGroup(name), logContent: h.logContent}
+}
+
+func (h *redactingHandler) scrub(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	key := strings.ToLower(a.Key)
+	switch {
+	case secretKeys[key]:
+		return slog.String(a.Key, "[redacted]")
+	case contentKeys[key] && !h.logContent:
+		return slog.String(a.Key, contentSummary(a.Value))
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		scrubbed := make([]any, len(group))
+		for i, inner := range group {
+			scrubbed[i] = h.scrub(inner)
+		}
+		return slog.Group(a.Key, scrubbed...)
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,75 @@
+package Logging
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrorRecord is a reported error, kept so admins can look it up by reference.
+type ErrorRecord struct {
+	Ref     string
+	GuildID string
+	Action  string
+	// Error is the redacted error text.
+	Error string
+	Time  time.Time
+}
+
+// maxRecords bounds how many recent errors are kept for lookup.
+const maxRecords = 500
+
+var (
+	recordsMu sync.Mutex
+	records   []ErrorRecord
+)
+
+// failures are in-character replies shown in place of an internal error.
+var failures = []string{
+	"ugh, something in the underworld just broke. try again in a bit",
+	"the queen is... indisposed. something went wrong on my end",
+	"my hellfire sputtered out for a second there. give it another go",
+	"something cursed happened behind the scenes. not your fault, probably",
+}
+
+// UserError logs err at error level under a new reference ID and returns a
+// message that is safe to show in the channel: a persona line and the
+// reference, but none of the error's details.
+func UserError(guildID string, action string, err error) string {
+	ref := Report(guildID, action, err)
+	return fmt.Sprintf("%s (ref `%s`)", failures[rand.Intn(len(failures))], ref)
+}
+
+// Report logs err under a new reference ID, remembers it for Lookup and returns
+// the reference.
+func Report(guildID string, action string, err error) string {
+	ref := newRef()
+	slog.Error("Request failed", "ref", ref, "guild", guildID, "action", action, "err", err)
+
+	record := ErrorRecord{Ref: ref, GuildID: guildID, Action: action, Error: Redact(err.Error()), Time: time.Now()}
+	recordsMu.Lock()
+	records = append(records, record)
+	if len(records) > maxRecords {
+		records = records[len(records)-maxRecords:]
+	}
+	recordsMu.Unlock()
+	return ref
+}
+
+// Lookup finds a recently reported error by reference.
+func Lookup(ref string) (ErrorRecord, bool) {
+	recordsMu.Lock()
+	defer recordsMu.Unlock()
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Ref == ref {
+			return records[i], true
+		}
+	}
+	return ErrorRecord{}, false
+}
+
+func newRef() string {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
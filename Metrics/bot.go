@@ -0,0 +1,33 @@
+package Metrics
+
+// The bot's metrics. Guild labels hold server IDs.
+var (
+	Messages = NewCounter("hellish_messages_total",
+		"Messages handled, by guild and command. Messages without a command count as \"chat\".",
+		"guild", "command")
+
+	AIDuration = NewHistogram("hellish_ai_request_duration_seconds",
+		"Time to get a reply from Gemini, across every key tried, by result: ok, blocked, no_keys, cancelled or error.",
+		SlowBuckets, "result")
+	AITokens = NewCounter("hellish_ai_tokens_total",
+		"Gemini tokens used, by guild and type: prompt or output.",
+		"guild", "type")
+	AIKeyFailures = NewCounter("hellish_ai_key_failures_total",
+		"Gemini calls that failed with one API key, by HTTP status, or transport, api_error or empty.",
+		"status")
+	AIRetries = NewCounter("hellish_ai_retries_total",
+		"Gemini calls retried with the server's next API key.")
+
+	DatabaseDuration = NewHistogram("hellish_mongo_command_duration_seconds",
+		"MongoDB command latency, by command.",
+		FastBuckets, "command")
+	DatabaseErrors = NewCounter("hellish_mongo_command_errors_total",
+		"MongoDB commands that failed, by command.",
+		"command")
+
+	GatewayReconnects = NewCounter("hellish_gateway_reconnects_total",
+		"Gateway reconnects, by shard.",
+		"shard")
+	QueueDropped = NewCounter("hellish_chat_queue_dropped_total",
+		"Chat messages ignored because their channel's queue was full.")
+)
@@ -0,0 +1,115 @@
+package Metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// output returns what a metric writes, without registering anything new.
+func output(m metric) string {
+	var b strings.Builder
+	m.write(&b)
+	return b.String()
+}
+
+func TestCounterExposition(t *testing.T) {
+	c := &Counter{desc: desc{"test_requests_total", "Requests handled.", []string{"guild", "command"}}, values: map[string]float64{}}
+	c.Inc("2", "chat")
+	c.Add(2.5, "1", "ask")
+	c.Inc("1", "ask")
+	c.Inc("1", "quote \" back\\slash\nnewline")
+
+	want := `# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total{guild="1",command="ask"} 3.5
+test_requests_total{guild="1",command="quote \" back\\slash\nnewline"} 1
+test_requests_total{guild="2",command="chat"} 1
+`
+	if got := output(c); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	c := &Counter{desc: desc{metricName: "test_retries_total", help: "Retries."}, values: map[string]float64{"": 0}}
+	want := "# HELP test_retries_total Retries.\n# TYPE test_retries_total counter\ntest_retries_total 0\n"
+	if got := output(c); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	h := &Histogram{desc: desc{"test_duration_seconds", "Latency.", []string{"result"}}, buckets: []float64{0.1, 1, 10}, series: map[string]*histogramSeries{}}
+	for _, v := range []float64{0.05, 0.1, 0.5, 20} {
+		h.Observe(v, "ok")
+	}
+
+	want := `# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{result="ok",le="0.1"} 2
+test_duration_seconds_bucket{result="ok",le="1"} 3
+test_duration_seconds_bucket{result="ok",le="10"} 3
+test_duration_seconds_bucket{result="ok",le="+Inf"} 4
+test_duration_seconds_sum{result="ok"} 20.65
+test_duration_seconds_count{result="ok"} 4
+`
+	if got := output(h); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGaugeFuncExposition(t *testing.T) {
+	g := &GaugeFunc{desc: desc{metricName: "test_queue_depth", help: "Waiting."}, read: func() float64 { return 7 }}
+	want := "# HELP test_queue_depth Waiting.\n# TYPE test_queue_depth gauge\ntest_queue_depth 7\n"
+	if got := output(g); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCounterFuncExposition(t *testing.T) {
+	c := &CounterFunc{desc: desc{metricName: "test_hits_total", help: "Hits."}, read: func() float64 { return 42 }}
+	want := "# HELP test_hits_total Hits.\n# TYPE test_hits_total counter\ntest_hits_total 42\n"
+	if got := output(c); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("a wrong number of label values didn't panic")
+		}
+	}()
+	c := &Counter{desc: desc{"test_mismatch_total", "", []string{"guild"}}, values: map[string]float64{}}
+	c.Inc("1", "extra")
+}
+
+func TestHandler(t *testing.T) {
+	NewGaugeFunc("test_handler_b", "Second.", func() float64 { return 1 })
+	NewGaugeFunc("test_handler_a", "First.", func() float64 { return 2 })
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	a, b := strings.Index(body, "# HELP test_handler_a"), strings.Index(body, "# HELP test_handler_b")
+	if a < 0 || b < 0 || a > b {
+		t.Errorf("metrics missing or not sorted by name:\n%s", body)
+	}
+	// Every line is a comment or a sample with a value.
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if !strings.HasPrefix(line, "# ") && len(strings.Fields(line)) < 2 {
+			t.Errorf("malformed line %q", line)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice didn't panic")
+		}
+	}()
+	NewGaugeFunc("test_handler_a", "Again.", func() float64 { return 0 })
+}
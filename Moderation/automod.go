@@ -0,0 +1,108 @@
+package Moderation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hellish/AI"
+	"hellish/Database"
+	"slices"
+)
+
+// Auto-mod categories and actions. Actions are ordered by severity and each one
+// also performs the ones before it, so "warn" deletes the message and logs it.
+var (
+	Categories = []string{"toxicity", "spam", "scam"}
+	Actions    = []string{"log", "delete", "warn", "timeout"}
+)
+
+const (
+	DefaultThreshold      = 0.8
+	DefaultTimeoutMinutes = 10
+)
+
+var defaultActions = map[string]string{
+	"toxicity": "warn",
+	"spam":     "delete",
+	"scam":     "delete",
+}
+
+// Decision is what the auto-mod decided to do about a message.
+type Decision struct {
+	Category string
+	Score    float64
+	Action   string
+	Reason   string
+}
+
+// Watches reports whether the auto-mod is enabled for the given channel.
+func Watches(settings Database.AutoMod, channelID string) bool {
+	return settings.Enabled && slices.Contains(settings.Channels, channelID)
+}
+
+// Threshold returns the configured threshold for a category, or the default.
+func Threshold(settings Database.AutoMod, category string) float64 {
+	if t, ok := settings.Thresholds[category]; ok {
+		return t
+	}
+	return DefaultThreshold
+}
+
+// Action returns the configured action for a category, or the default.
+func Action(settings Database.AutoMod, category string) string {
+	if a, ok := settings.Actions[category]; ok && a != "" {
+		return a
+	}
+	return defaultActions[category]
+}
+
+// TimeoutMinutes returns the configured timeout length, or the default.
+func TimeoutMinutes(settings Database.AutoMod) int {
+	if settings.TimeoutMinutes > 0 {
+		return settings.TimeoutMinutes
+	}
+	return DefaultTimeoutMinutes
+}
+
+// Includes reports whether an action performs another, less severe action.
+func Includes(action, other string) bool {
+	return slices.Index(Actions, action) >= slices.Index(Actions, other)
+}
+
+// Classifier rates messages for the auto-mod. *AI.Client is one.
+type Classifier interface {
+	ClassifyMessage(ctx context.Context, guildID, text string) (*AI.MessageScores, error)
+}
+
+// Evaluate classifies a message and returns the most severe action triggered by
+// any category that crossed its threshold. It returns nil if nothing triggered.
+// A message the classifier refuses to read is rated as toxic as can be.
+func Evaluate(ctx context.Context, ai Classifier, guildID string, settings Database.AutoMod, text string) (*Decision, error) {
+	scores, err := ai.ClassifyMessage(ctx, guildID, text)
+	var blocked *AI.BlockedError
+	if errors.As(err, &blocked) {
+		scores, err = &AI.MessageScores{Toxicity: 1, Reason: "the classifier refused to rate the message (" + blocked.Reason + ")"}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not classify message: %w", err)
+	}
+
+	values := map[string]float64{
+		"toxicity": scores.Toxicity,
+		"spam":     scores.Spam,
+		"scam":     scores.Scam,
+	}
+
+	var decision *Decision
+	for _, category := range Categories {
+		score := values[category]
+		if score < Threshold(settings, category) {
+			continue
+		}
+		action := Action(settings, category)
+		if decision == nil || !Includes(decision.Action, action) {
+			decision = &Decision{Category: category, Score: score, Action: action, Reason: scores.Reason}
+		}
+	}
+	return decision, nil
+}
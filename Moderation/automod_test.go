@@ -0,0 +1,74 @@
+package Moderation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hellish/AI"
+	"hellish/Database"
+	"testing"
+)
+
+// fakeClassifier returns fixed scores or a fixed error.
+type fakeClassifier struct {
+	scores *AI.MessageScores
+	err    error
+}
+
+func (f fakeClassifier) ClassifyMessage(context.Context, string, string) (*AI.MessageScores, error) {
+	return f.scores, f.err
+}
+
+func TestEvaluate(t *testing.T) {
+	settings := Database.AutoMod{Enabled: true, Actions: map[string]string{"spam": "log"}}
+	blocked := fmt.Errorf("generate: %w", &AI.BlockedError{Reason: "SAFETY"})
+
+	tests := []struct {
+		name       string
+		classifier fakeClassifier
+		want       *Decision // only Category, Score and Action are compared
+		err        bool
+	}{
+		{
+			name:       "below every threshold",
+			classifier: fakeClassifier{scores: &AI.MessageScores{Toxicity: 0.5, Spam: 0.79}},
+		},
+		{
+			name:       "one category",
+			classifier: fakeClassifier{scores: &AI.MessageScores{Spam: 0.9}},
+			want:       &Decision{Category: "spam", Score: 0.9, Action: "log"},
+		},
+		{
+			name:       "most severe action wins",
+			classifier: fakeClassifier{scores: &AI.MessageScores{Toxicity: 0.85, Spam: 0.95, Scam: 0.9}},
+			want:       &Decision{Category: "toxicity", Score: 0.85, Action: "warn"},
+		},
+		{
+			name:       "refused by the classifier",
+			classifier: fakeClassifier{err: blocked},
+			want:       &Decision{Category: "toxicity", Score: 1, Action: "warn"},
+		},
+		{
+			name:       "classifier failure",
+			classifier: fakeClassifier{err: errors.New("unavailable")},
+			err:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := Evaluate(context.Background(), tt.classifier, "1", settings, "text")
+			if (err != nil) != tt.err {
+				t.Fatalf("Evaluate returned error %v", err)
+			}
+			switch {
+			case tt.want == nil && decision != nil:
+				t.Errorf("Evaluate = %+v, want no action", decision)
+			case tt.want != nil && decision == nil:
+				t.Errorf("Evaluate took no action, want %+v", tt.want)
+			case tt.want != nil && (decision.Category != tt.want.Category || decision.Score != tt.want.Score || decision.Action != tt.want.Action):
+				t.Errorf("Evaluate = %+v, want %+v", decision, tt.want)
+			}
+		})
+	}
+}
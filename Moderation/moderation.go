@@ -0,0 +1,124 @@
+package Moderation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hellish/AI"
+	"hellish/Database"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Verdict is the outcome of moderating a reply.
+type Verdict struct {
+	Blocked bool
+	Source  string // "model", "wordlist", "pattern" or "classifier"
+	Reason  string
+}
+
+// refusals are in-character replies used in place of a blocked message.
+var refusals = []string{
+	"nope. even hell has rules, and that one's mine 😈",
+	"mm, not saying that here. pick another topic, mortal",
+	"the queen declines. try something that won't get us both banished",
+	"lol no. ask me something else before i get bored",
+}
+
+// compiled caches compiled blocked patterns across calls.
+var compiled sync.Map
+
+// Refusal returns a persona-appropriate message to post instead of a blocked reply.
+func Refusal() string {
+	return refusals[rand.Intn(len(refusals))]
+}
+
+// CheckError turns a model-side block returned by AI.Generate into a verdict.
+// It reports false if err is not a block.
+func CheckError(err error) (Verdict, bool) {
+	var blocked *AI.BlockedError
+	if !errors.As(err, &blocked) {
+		return Verdict{}, false
+	}
+	return Verdict{Blocked: true, Source: "model", Reason: blocked.Reason}, true
+}
+
+// CheckReply runs a generated reply through a server's moderation settings:
+// Gemini's safety ratings, the blocked word and pattern lists, and optionally the
+// second-pass classifier. NSFW channels allow sexual content and only block other
+// categories on high-probability ratings.
+func CheckReply(ctx context.Context, ai *AI.Client, guildID string, settings Database.Moderation, nsfw bool, reply *AI.Reply) (Verdict, error) {
+	if v := checkRatings(reply.SafetyRatings, nsfw); v.Blocked {
+		return v, nil
+	}
+
+	for _, word := range settings.BlockedWords {
+		re, err := compile(`(?i)\b` + regexp.QuoteMeta(word) + `\b`)
+		if err == nil && re.MatchString(reply.Text) {
+			return Verdict{Blocked: true, Source: "wordlist", Reason: fmt.Sprintf("contains blocked word %q", word)}, nil
+		}
+	}
+	for _, pattern := range settings.BlockedPatterns {
+		re, err := compile(pattern)
+		if err == nil && re.MatchString(reply.Text) {
+			return Verdict{Blocked: true, Source: "pattern", Reason: fmt.Sprintf("matches blocked pattern %q", pattern)}, nil
+		}
+	}
+
+	if settings.Classifier {
+		channelContext := "regular channel, keep it safe for work"
+		if nsfw {
+			channelContext = "NSFW channel, adult content is allowed"
+		}
+		result, err := ai.Classify(ctx, guildID, channelContext, reply.Text)
+		if err != nil {
+			return Verdict{}, fmt.Errorf("classifier pass failed: %w", err)
+		}
+		if result.Flagged {
+			return Verdict{Blocked: true, Source: "classifier", Reason: result.Reason}, nil
+		}
+	}
+
+	return Verdict{}, nil
+}
+
+// ValidatePattern reports whether a blocked pattern is a valid regular expression.
+func ValidatePattern(pattern string) error {
+	_, err := regexp.Compile(pattern)
+	return err
+}
+
+func checkRatings(ratings []AI.SafetyRating, nsfw bool) Verdict {
+	for _, rating := range ratings {
+		if nsfw && rating.Category == "HARM_CATEGORY_SEXUALLY_EXPLICIT" && !rating.Blocked {
+			continue
+		}
+		blocked := rating.Blocked || rating.Probability == "HIGH"
+		if !nsfw && rating.Probability == "MEDIUM" {
+			blocked = true
+		}
+		if blocked {
+			category := strings.TrimPrefix(rating.Category, "HARM_CATEGORY_")
+			return Verdict{
+				Blocked: true,
+				Source:  "model",
+				Reason:  fmt.Sprintf("%s rated %s", strings.ToLower(category), strings.ToLower(rating.Probability)),
+			}
+		}
+	}
+	return Verdict{}
+}
+
+func compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := compiled.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	compiled.Store(pattern, re)
+	return re, nil
+}
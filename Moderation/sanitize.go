@@ -0,0 +1,143 @@
+package Moderation
+
+import (
+	"hellish/Database"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Who an AI reply may ping. Nobody can be pinged through @everyone, @here or
+// a role, whatever the policy.
+const (
+	MentionsNone   = "none"
+	MentionsAuthor = "author"
+	MentionsUsers  = "users"
+)
+
+// DefaultEmojiLimit caps emoji per reply unless a server sets its own limit.
+const DefaultEmojiLimit = 10
+
+var (
+	massMention  = regexp.MustCompile(`@(everyone|here)`)
+	inviteLink   = regexp.MustCompile(`(?i)(?:https?://)?(?:www\.)?(?:discord(?:app)?\.com/invite|discord\.gg|dsc\.gg)/[a-z0-9-]+`)
+	maskedLink   = regexp.MustCompile(`\[([^\[\]]+)\]\(\s*<?(https?://[^\s()<>]+)>?(?:\s+"[^"]*")?\s*\)`)
+	customEmoji  = regexp.MustCompile(`<a?:\w{2,32}:\d+>`)
+	markdownChar = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `_`, `\_`, `~`, `\~`, `|`, `\|`, "`", "\\`", `[`, `\[`, `]`, `\]`, `>`, `\>`)
+)
+
+// MentionPolicy returns who a server lets AI replies ping, "author" by default.
+func MentionPolicy(policy Database.OutputPolicy) string {
+	switch policy.Mentions {
+	case MentionsNone, MentionsUsers:
+		return policy.Mentions
+	default:
+		return MentionsAuthor
+	}
+}
+
+// EmojiLimit returns how many emoji a reply may contain, or -1 for no limit.
+func EmojiLimit(policy Database.OutputPolicy) int {
+	switch {
+	case policy.EmojiLimit < 0:
+		return -1
+	case policy.EmojiLimit == 0:
+		return DefaultEmojiLimit
+	default:
+		return policy.EmojiLimit
+	}
+}
+
+// Sanitize cleans up an AI reply before it is posted. @everyone and @here are
+// defused, and unless the policy allows them, invite links are removed, masked
+// links show where they really go, emoji beyond the limit are dropped and
+// unclosed code blocks are closed.
+func Sanitize(text string, policy Database.OutputPolicy) string {
+	text = massMention.ReplaceAllString(text, "@\u200b$1")
+	if !policy.AllowInvites {
+		text = inviteLink.ReplaceAllString(text, "[invite removed]")
+	}
+	if !policy.AllowMaskedLinks {
+		text = maskedLink.ReplaceAllString(text, "$1 (<$2>)")
+	}
+	if limit := EmojiLimit(policy); limit >= 0 {
+		text = capEmoji(text, limit)
+	}
+	if !policy.RawMarkdown && strings.Count(text, "```")%2 == 1 {
+		text += "\n```"
+	}
+	return text
+}
+
+// EscapeMarkdown escapes text for use inside Discord markup, such as a spoiler
+// or an embed field, so it can't end the markup early or add links of its own.
+func EscapeMarkdown(text string) string {
+	return markdownChar.Replace(text)
+}
+
+// capEmoji drops every emoji after the first limit, counting custom emoji and
+// multi-codepoint sequences such as flags as one each.
+func capEmoji(text string, limit int) string {
+	customs := customEmoji.FindAllStringIndex(text, -1)
+	var b strings.Builder
+	count, keep := 0, true
+	var prev rune
+	for i := 0; i < len(text); {
+		if len(customs) > 0 && customs[0][0] == i {
+			end := customs[0][1]
+			customs = customs[1:]
+			count++
+			if count <= limit {
+				b.WriteString(text[i:end])
+			}
+			i, prev = end, 0
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case continuesEmoji(prev, r):
+			// Part of the emoji before it, kept or dropped with it.
+		case isEmoji(r):
+			count++
+			keep = count <= limit
+		default:
+			keep = true
+		}
+		if keep {
+			b.WriteString(text[i : i+size])
+		}
+		i += size
+		// The second flag letter ends the pair, so a third starts a new flag.
+		if isRegionalIndicator(prev) && isRegionalIndicator(r) {
+			r = 0
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+func isEmoji(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) || (r >= 0x2600 && r <= 0x27BF) || (r >= 0x2B00 && r <= 0x2BFF)
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// continuesEmoji reports whether r belongs to the emoji sequence before it:
+// joiners, variation selectors, skin tones, keycaps, tags, the emoji after a
+// joiner and the second letter of a flag.
+func continuesEmoji(prev, r rune) bool {
+	switch {
+	case prev == 0:
+		return false
+	case r == 0x200D || r == 0xFE0F || r == 0x20E3 || (r >= 0x1F3FB && r <= 0x1F3FF) || (r >= 0xE0020 && r <= 0xE007F):
+		return isEmoji(prev) || prev == 0x200D || prev == 0xFE0F || (prev >= 0x1F3FB && prev <= 0x1F3FF) || (prev >= 0xE0020 && prev <= 0xE007F)
+	case prev == 0x200D:
+		return isEmoji(r)
+	case isRegionalIndicator(prev) && isRegionalIndicator(r):
+		return true
+	}
+	return false
+}
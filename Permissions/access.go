@@ -0,0 +1,48 @@
+package Permissions
+
+import (
+	"hellish/Database"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// CanChat checks the server-wide and channel access lists for a user. Deny entries
+// win over allow entries at either level. A non-empty channel allow list replaces the
+// server-wide one for that channel. Members with Manage Server are never blocked.
+// When access is refused, the reason is suitable for showing to the user.
+func CanChat(guild Database.AccessList, channel Database.AccessList, userID string, roles []string, perms int64) (bool, string) {
+	if perms&discordgo.PermissionManageGuild != 0 {
+		return true, ""
+	}
+
+	for _, list := range []Database.AccessList{channel, guild} {
+		if slices.Contains(list.DenyUsers, userID) {
+			return false, "you've been blocked from chatting with me"
+		}
+		if hasAnyRole(list.DenyRoles, roles) {
+			return false, "one of your roles is blocked from chatting with me"
+		}
+	}
+
+	allow := guild
+	if len(channel.AllowRoles) > 0 || len(channel.AllowUsers) > 0 {
+		allow = channel
+	}
+	if len(allow.AllowRoles) == 0 && len(allow.AllowUsers) == 0 {
+		return true, ""
+	}
+	if slices.Contains(allow.AllowUsers, userID) || hasAnyRole(allow.AllowRoles, roles) {
+		return true, ""
+	}
+	return false, "chatting with me here is limited to certain roles"
+}
+
+func hasAnyRole(list []string, roles []string) bool {
+	for _, role := range roles {
+		if slices.Contains(list, role) {
+			return true
+		}
+	}
+	return false
+}
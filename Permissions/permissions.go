@@ -0,0 +1,79 @@
+package Permissions
+
+import (
+	"hellish/Database"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Capability is something a role or user can be allowed to do with the bot.
+type Capability struct {
+	Name        string
+	Description string
+	// Default is the Discord permission that grants the capability while the
+	// server has not granted it to anyone explicitly. Zero means everyone.
+	Default int64
+}
+
+const (
+	ManageKeys       = "manage_keys"
+	EditSystem       = "edit_system"
+	Activate         = "activate"
+	Chat             = "chat"
+	BypassLimits     = "bypass_limits"
+	ManageModeration = "manage_moderation"
+	ViewAudit        = "view_audit"
+	ManageAccess     = "manage_access"
+)
+
+// Capabilities lists every capability in the order they are shown to users.
+var Capabilities = []Capability{
+	{ManageKeys, "Add, remove and clear API keys", discordgo.PermissionManageGuild},
+	{EditSystem, "Edit the system message", discordgo.PermissionManageGuild},
+	{Activate, "Choose the channel the AI chats in", discordgo.PermissionManageGuild},
+	{Chat, "Chat with the AI", 0},
+	{BypassLimits, "Bypass automated limits such as the auto-mod", discordgo.PermissionManageMessages},
+	{ManageModeration, "Configure moderation and the auto-mod, and resolve appeals", discordgo.PermissionManageGuild},
+	{ViewAudit, "View and configure the audit log", discordgo.PermissionManageGuild},
+	{ManageAccess, "Edit who may chat with the AI", discordgo.PermissionManageGuild},
+}
+
+// Lookup returns the capability with the given name.
+func Lookup(name string) (Capability, bool) {
+	for _, c := range Capabilities {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Capability{}, false
+}
+
+// Allowed reports whether a user has a capability. Members with Manage Server always
+// have every capability so a server can't lock itself out. Otherwise, explicit grants
+// to the user or one of their roles win; if the capability has no grants at all, the
+// capability's default Discord permission applies.
+func Allowed(grants map[string]Database.Grant, capability string, userID string, roles []string, perms int64) bool {
+	if perms&discordgo.PermissionManageGuild != 0 {
+		return true
+	}
+
+	grant, granted := grants[capability]
+	if granted && (len(grant.Users) > 0 || len(grant.Roles) > 0) {
+		if slices.Contains(grant.Users, userID) {
+			return true
+		}
+		for _, role := range roles {
+			if slices.Contains(grant.Roles, role) {
+				return true
+			}
+		}
+		return false
+	}
+
+	c, ok := Lookup(capability)
+	if !ok {
+		return false
+	}
+	return c.Default == 0 || perms&c.Default != 0
+}
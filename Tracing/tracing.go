@@ -0,0 +1,80 @@
+// Package Tracing records OpenTelemetry traces of message handling and exports
+// them over OTLP. Until Init turns exporting on, spans cost next to nothing.
+package Tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("hellish")
+
+// Init exports traces over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set, and leaves tracing off otherwise.
+// The other standard OTEL_* variables apply, e.g. OTEL_EXPORTER_OTLP_HEADERS,
+// OTEL_SERVICE_NAME and OTEL_TRACES_SAMPLER. Call the returned function on
+// exit to flush the spans still buffered.
+func Init(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	shutdown = func(context.Context) error { return nil }
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" ||
+		(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "") {
+		return shutdown, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return shutdown, fmt.Errorf("could not create the OTLP exporter: %w", err)
+	}
+	// Later options win, so OTEL_SERVICE_NAME overrides the default name.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "hellish")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return shutdown, fmt.Errorf("could not describe the service for traces: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("Tracing error", "err", err)
+	}))
+	slog.Info("Exporting traces over OTLP")
+	return provider.Shutdown, nil
+}
+
+// Start begins a span as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Fail marks a span failed with err. Cancellation isn't a failure, but is
+// recorded as an event.
+func Fail(span trace.Span, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, context.Canceled):
+		span.AddEvent("cancelled")
+	default:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// End ends a span, marking it failed if err is set.
+func End(span trace.Span, err error) {
+	Fail(span, err)
+	span.End()
+}
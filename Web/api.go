@@ -0,0 +1,330 @@
+package Web
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hellish/Audit"
+	"hellish/Database"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Limits on what the dashboard accepts, so one request can't bloat a server's
+// document or every prompt built from it.
+const (
+	maxSystemMessage = 4000
+	maxPersona       = 8000
+	maxAPIKey        = 200
+	maxRequestBody   = 64 << 10
+	usageDays        = 30
+)
+
+// errInvalid marks errors caused by the request; their message is shown to
+// the user.
+var errInvalid = errors.New("invalid request")
+
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errInvalid, fmt.Sprintf(format, args...))
+}
+
+// statusFor maps an error from a change to the HTTP status and the message the
+// user sees.
+func statusFor(err error) (int, string) {
+	switch {
+	case errors.Is(err, errInvalid):
+		return http.StatusBadRequest, strings.TrimPrefix(err.Error(), errInvalid.Error()+": ")
+	case errors.Is(err, Database.ErrDuplicateAPIKey):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, Database.ErrAPIKeyNotFound):
+		return http.StatusNotFound, err.Error()
+	default:
+		return http.StatusInternalServerError, "Something went wrong, please try again later."
+	}
+}
+
+// api requires a logged-in user.
+func (srv *Server) api(handler func(http.ResponseWriter, *http.Request, *session)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := srv.currentSession(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "Log in at /login first.", nil)
+			return
+		}
+		handler(w, r, sess)
+	}
+}
+
+// guildAPI also requires the user to manage the server in the path. Changes
+// must be sent as JSON, which a cross-site form can't do.
+func (srv *Server) guildAPI(handler func(http.ResponseWriter, *http.Request, *session, string)) http.HandlerFunc {
+	return srv.api(func(w http.ResponseWriter, r *http.Request, sess *session) {
+		guildID := r.PathValue("guild")
+		if _, ok := sess.Guilds[guildID]; !ok {
+			writeError(w, http.StatusForbidden, "You need Manage Server on that server.", nil)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, "Send the request body as application/json.", nil)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+		}
+		handler(w, r, sess, guildID)
+	})
+}
+
+// validCSRF reports whether a form carries the session's CSRF token.
+func validCSRF(r *http.Request, sess *session) bool {
+	return subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(sess.CSRF)) == 1
+}
+
+func (srv *Server) apiMe(w http.ResponseWriter, r *http.Request, sess *session) {
+	writeJSON(w, http.StatusOK, map[string]string{"id": sess.UserID, "username": sess.Username})
+}
+
+func (srv *Server) apiGuilds(w http.ResponseWriter, r *http.Request, sess *session) {
+	writeJSON(w, http.StatusOK, sortedGuilds(sess))
+}
+
+// guildView is what the API shows of a server's configuration.
+type guildView struct {
+	Guild
+	Channel       string    `json:"channel,omitempty"`
+	SystemMessage string    `json:"system_message"`
+	Persona       string    `json:"persona"`
+	Keys          []keyView `json:"keys"`
+}
+
+// keyView identifies an API key without revealing it.
+type keyView struct {
+	Fingerprint string `json:"fingerprint"`
+	Masked      string `json:"masked"`
+}
+
+func (srv *Server) apiGuild(w http.ResponseWriter, r *http.Request, sess *session, guildID string) {
+	view, err := srv.guildView(r.Context(), sess, guildID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not load the server.", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (srv *Server) apiSetSystemMessage(w http.ResponseWriter, r *http.Request, sess *session, guildID string) {
+	var body struct {
+		SystemMessage string `json:"system_message"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	srv.respond(w, srv.setSystemMessage(r.Context(), sess, guildID, body.SystemMessage), http.StatusNoContent)
+}
+
+func (srv *Server) apiSetPersona(w http.ResponseWriter, r *http.Request, sess *session, guildID string) {
+	var body struct {
+		Persona string `json:"persona"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	srv.respond(w, srv.setPersona(r.Context(), sess, guildID, body.Persona), http.StatusNoContent)
+}
+
+func (srv *Server) apiKeys(w http.ResponseWriter, r *http.Request, sess *session, guildID string) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	keys, err := srv.keys(ctx, guildID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not load the API keys.", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func (srv *Server) apiAddKey(w http.ResponseWriter, r *http.Request, sess *session, guildID string) {
+	var body struct {
+		Key string `json:"key"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	srv.respond(w, srv.addKey(r.Context(), sess, guildID, body.Key), http.StatusCreated)
+}
+
+func (srv *Server) apiRemoveKey(w http.ResponseWriter, r *http.Request, sess *session, guildID string) {
+	srv.respond(w, srv.removeKey(r.Context(), sess, guildID, r.PathValue("fingerprint")), http.StatusNoContent)
+}
+
+// usageDay is one day of a server's AI usage.
+type usageDay struct {
+	Date string `json:"date"`
+	Database.Usage
+}
+
+func (srv *Server) apiUsage(w http.ResponseWriter, r *http.Request, sess *session, guildID string) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	days, err := srv.recentUsage(ctx, guildID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not load usage.", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, days)
+}
+
+// decodeJSON reads the request body into out, answering 400 if it can't.
+func decodeJSON(w http.ResponseWriter, r *http.Request, out any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
+		writeError(w, http.StatusBadRequest, "The request body is not valid JSON for this endpoint.", nil)
+		return false
+	}
+	return true
+}
+
+// respond answers a change with status, or with the error it failed with.
+func (srv *Server) respond(w http.ResponseWriter, err error, status int) {
+	if err != nil {
+		code, message := statusFor(err)
+		if code != http.StatusInternalServerError {
+			err = nil
+		}
+		writeError(w, code, message, err)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// The changes below are shared by the API and the dashboard forms. Each is
+// recorded in the server's audit log under the dashboard user's name.
+
+func (srv *Server) setSystemMessage(ctx context.Context, sess *session, guildID, message string) error {
+	message = strings.TrimSpace(message)
+	if len(message) > maxSystemMessage {
+		return invalid("The system message can be at most %d characters.", maxSystemMessage)
+	}
+	return srv.change(ctx, sess, guildID, "dashboard.system-message", func(ctx context.Context) error {
+		return srv.db.InsertSystemMessage(ctx, guildID, message)
+	})
+}
+
+func (srv *Server) setPersona(ctx context.Context, sess *session, guildID, persona string) error {
+	persona = strings.TrimSpace(persona)
+	if len(persona) > maxPersona {
+		return invalid("The persona can be at most %d characters.", maxPersona)
+	}
+	return srv.change(ctx, sess, guildID, "dashboard.persona", func(ctx context.Context) error {
+		return srv.db.SetPersona(ctx, guildID, persona)
+	})
+}
+
+func (srv *Server) addKey(ctx context.Context, sess *session, guildID, key string) error {
+	key = strings.TrimSpace(key)
+	if key == "" || len(key) > maxAPIKey || strings.ContainsAny(key, " \t\r\n") {
+		return invalid("That doesn't look like an API key.")
+	}
+	return srv.change(ctx, sess, guildID, "dashboard.keys.add", func(ctx context.Context) error {
+		return srv.db.AddAPIKey(ctx, guildID, key)
+	})
+}
+
+// removeKey removes the key with the given fingerprint, since the dashboard
+// never sees keys in full.
+func (srv *Server) removeKey(ctx context.Context, sess *session, guildID, fingerprint string) error {
+	return srv.change(ctx, sess, guildID, "dashboard.keys.remove", func(ctx context.Context) error {
+		keys, err := srv.db.APIKeys(ctx, guildID)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if Audit.Fingerprint(key) == fingerprint {
+				return srv.db.RemoveAPIKey(ctx, guildID, key)
+			}
+		}
+		return Database.ErrAPIKeyNotFound
+	})
+}
+
+// change applies a change to a server and records it in the audit log.
+func (srv *Server) change(ctx context.Context, sess *session, guildID, action string, apply func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	before := Audit.Take(ctx, srv.db, guildID)
+	if err := apply(ctx); err != nil {
+		return err
+	}
+	if _, err := Audit.Record(ctx, srv.db, guildID, sess.UserID, sess.Username, action, before); err != nil {
+		// The change went through, so only log that it couldn't be audited.
+		slog.Error("Error recording audit entry", "guild", guildID, "action", action, "err", err)
+	}
+	return nil
+}
+
+// guildView loads what the dashboard shows of a server.
+func (srv *Server) guildView(ctx context.Context, sess *session, guildID string) (guildView, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	config, err := srv.db.ViewServer(ctx, guildID)
+	if err != nil {
+		return guildView{}, err
+	}
+	keys, err := srv.keys(ctx, guildID)
+	if err != nil {
+		return guildView{}, err
+	}
+	return guildView{
+		Guild:         sess.Guilds[guildID],
+		Channel:       config.ActivateChannel,
+		SystemMessage: config.SystemMessage,
+		Persona:       config.Persona,
+		Keys:          keys,
+	}, nil
+}
+
+// keys lists a server's API keys by fingerprint.
+func (srv *Server) keys(ctx context.Context, guildID string) ([]keyView, error) {
+	keys, err := srv.db.APIKeys(ctx, guildID)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]keyView, 0, len(keys))
+	for _, key := range keys {
+		masked := "****"
+		if len(key) > 8 {
+			masked = key[:4] + "..." + key[len(key)-4:]
+		}
+		views = append(views, keyView{Fingerprint: Audit.Fingerprint(key), Masked: masked})
+	}
+	return views, nil
+}
+
+// recentUsage returns the server's usage over the last usageDays days, newest first.
+func (srv *Server) recentUsage(ctx context.Context, guildID string) ([]usageDay, error) {
+	records, err := srv.db.RecentUsage(ctx, guildID, usageDays)
+	if err != nil {
+		return nil, err
+	}
+	days := make([]usageDay, 0, len(records))
+	for _, record := range records {
+		days = append(days, usageDay{Date: record.Day, Usage: record.Usage})
+	}
+	return days, nil
+}
+
+// sortedGuilds lists the servers a user manages by name.
+func sortedGuilds(sess *session) []Guild {
+	guilds := make([]Guild, 0, len(sess.Guilds))
+	for _, guild := range sess.Guilds {
+		guilds = append(guilds, guild)
+	}
+	sort.Slice(guilds, func(i, j int) bool { return strings.ToLower(guilds[i].Name) < strings.ToLower(guilds[j].Name) })
+	return guilds
+}
@@ -0,0 +1,196 @@
+package Web
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+var templates = template.Must(template.New("layout").Parse(`{{define "layout"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Hellish dashboard</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+header { display: flex; justify-content: space-between; align-items: center; border-bottom: 1px solid #ddd; margin-bottom: 1.5rem; }
+textarea { width: 100%; min-height: 8rem; font-family: inherit; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 0.25rem 0.5rem; border-bottom: 1px solid #eee; }
+.error { background: #fde8e8; border: 1px solid #f5a3a3; padding: 0.5rem 1rem; }
+form.inline { display: inline; }
+</style>
+</head>
+<body>
+<header>
+<h1><a href="/">Hellish</a></h1>
+{{if .Session}}<form class="inline" method="post" action="/logout"><input type="hidden" name="csrf" value="{{.Session.CSRF}}">{{.Session.Username}} <button>Log out</button></form>{{end}}
+</header>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{template "content" .}}
+</body>
+</html>{{end}}`))
+
+var indexPage = template.Must(template.Must(templates.Clone()).Parse(`{{define "content"}}
+{{if not .Session}}
+<p>Log in with Discord to manage the servers you have Manage Server on.</p>
+<p><a href="/login">Log in with Discord</a></p>
+{{else if not .Guilds}}
+<p>You don't manage any servers.</p>
+{{else}}
+<h2>Your servers</h2>
+<ul>{{range .Guilds}}<li><a href="/guilds/{{.ID}}">{{.Name}}</a></li>{{end}}</ul>
+{{end}}
+{{end}}`))
+
+var guildPage = template.Must(template.Must(templates.Clone()).Parse(`{{define "content"}}
+{{$csrf := .Session.CSRF}}{{$id := .Guild.ID}}
+<h2>{{.Guild.Name}}</h2>
+{{if .Guild.Channel}}<p>Chat channel: <code>{{.Guild.Channel}}</code></p>{{else}}<p>No chat channel is set; use the activate command in Discord.</p>{{end}}
+
+<h3>System message</h3>
+<form method="post" action="/guilds/{{$id}}/system-message">
+<input type="hidden" name="csrf" value="{{$csrf}}">
+<textarea name="system_message">{{.Guild.SystemMessage}}</textarea>
+<button>Save</button>
+</form>
+
+<h3>Persona</h3>
+<p>Leave empty to use the built-in persona.</p>
+<form method="post" action="/guilds/{{$id}}/persona">
+<input type="hidden" name="csrf" value="{{$csrf}}">
+<textarea name="persona">{{.Guild.Persona}}</textarea>
+<button>Save</button>
+</form>
+
+<h3>API keys</h3>
+{{if .Guild.Keys}}<table>
+<tr><th>Key</th><th>Fingerprint</th><th></th></tr>
+{{range .Guild.Keys}}<tr><td><code>{{.Masked}}</code></td><td><code>{{.Fingerprint}}</code></td><td>
+<form class="inline" method="post" action="/guilds/{{$id}}/keys/{{.Fingerprint}}/delete"><input type="hidden" name="csrf" value="{{$csrf}}"><button>Remove</button></form>
+</td></tr>{{end}}
+</table>{{else}}<p>No API keys are set.</p>{{end}}
+<form method="post" action="/guilds/{{$id}}/keys">
+<input type="hidden" name="csrf" value="{{$csrf}}">
+<input type="password" name="key" placeholder="New API key" autocomplete="off" required>
+<button>Add</button>
+</form>
+
+<h3>Usage, last 30 days</h3>
+{{if .Usage}}<table>
+<tr><th>Date (UTC)</th><th>Replies</th><th>Prompt tokens</th><th>Output tokens</th></tr>
+{{range .Usage}}<tr><td>{{.Date}}</td><td>{{.Replies}}</td><td>{{.PromptTokens}}</td><td>{{.OutputTokens}}</td></tr>{{end}}
+</table>{{else}}<p>No replies yet.</p>{{end}}
+{{end}}`))
+
+// pageData is what the dashboard templates render.
+type pageData struct {
+	Session *session
+	Error   string
+	Guilds  []Guild
+	Guild   guildView
+	Usage   []usageDay
+}
+
+// page renders a dashboard page for anyone; sess is nil for logged-out users.
+func (srv *Server) page(handler func(http.ResponseWriter, *http.Request, *session)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := srv.currentSession(r)
+		handler(w, r, sess)
+	}
+}
+
+// guildPage renders a page about a server the user manages.
+func (srv *Server) guildPage(handler func(http.ResponseWriter, *http.Request, *session, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := srv.currentSession(r)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		guildID := r.PathValue("guild")
+		if _, ok := sess.Guilds[guildID]; !ok {
+			http.Error(w, "You need Manage Server on that server.", http.StatusForbidden)
+			return
+		}
+		handler(w, r, sess, guildID)
+	}
+}
+
+// guildForm handles a dashboard form about a server the user manages. The form
+// must carry the session's CSRF token. Afterwards the user is sent back to the
+// server's page, with the error if the change failed.
+func (srv *Server) guildForm(handler func(*http.Request, *session, string) error) http.HandlerFunc {
+	return srv.guildPage(func(w http.ResponseWriter, r *http.Request, sess *session, guildID string) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+		if !validCSRF(r, sess) {
+			http.Error(w, "This form has expired, please reload the page.", http.StatusForbidden)
+			return
+		}
+		target := "/guilds/" + url.PathEscape(guildID)
+		if err := handler(r, sess, guildID); err != nil {
+			status, message := statusFor(err)
+			if status == http.StatusInternalServerError {
+				slog.Error("Dashboard request failed", "guild", guildID, "err", err)
+			}
+			target += "?error=" + url.QueryEscape(message)
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+	})
+}
+
+func (srv *Server) pageIndex(w http.ResponseWriter, r *http.Request, sess *session) {
+	data := pageData{Session: sess}
+	if sess != nil {
+		data.Guilds = sortedGuilds(sess)
+	}
+	render(w, indexPage, data)
+}
+
+func (srv *Server) pageGuild(w http.ResponseWriter, r *http.Request, sess *session, guildID string) {
+	view, err := srv.guildView(r.Context(), sess, guildID)
+	if err != nil {
+		slog.Error("Dashboard request failed", "guild", guildID, "err", err)
+		http.Error(w, "Could not load the server.", http.StatusInternalServerError)
+		return
+	}
+	usage, err := srv.recentUsage(r.Context(), guildID)
+	if err != nil {
+		slog.Error("Dashboard request failed", "guild", guildID, "err", err)
+		http.Error(w, "Could not load the server.", http.StatusInternalServerError)
+		return
+	}
+	render(w, guildPage, pageData{
+		Session: sess,
+		Error:   r.URL.Query().Get("error"),
+		Guild:   view,
+		Usage:   usage,
+	})
+}
+
+func (srv *Server) formSystemMessage(r *http.Request, sess *session, guildID string) error {
+	return srv.setSystemMessage(r.Context(), sess, guildID, r.PostFormValue("system_message"))
+}
+
+func (srv *Server) formPersona(r *http.Request, sess *session, guildID string) error {
+	return srv.setPersona(r.Context(), sess, guildID, r.PostFormValue("persona"))
+}
+
+func (srv *Server) formAddKey(r *http.Request, sess *session, guildID string) error {
+	return srv.addKey(r.Context(), sess, guildID, r.PostFormValue("key"))
+}
+
+func (srv *Server) formRemoveKey(r *http.Request, sess *session, guildID string) error {
+	return srv.removeKey(r.Context(), sess, guildID, r.PathValue("fingerprint"))
+}
+
+// render writes a dashboard page.
+func render(w http.ResponseWriter, page *template.Template, data pageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'")
+	if err := page.ExecuteTemplate(w, "layout", data); err != nil {
+		slog.Error("Error rendering dashboard page", "err", err)
+	}
+}
@@ -0,0 +1,214 @@
+package Web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	discordAPI   = "https://discord.com/api/v10"
+	discordOAuth = "https://discord.com/oauth2/authorize"
+	stateCookie  = "hellish_oauth_state"
+
+	// Discord permission bits that let a user manage a server.
+	permissionAdministrator = 0x8
+	permissionManageServer  = 0x20
+)
+
+// oauthConfig is the Discord application the dashboard logs in with.
+type oauthConfig struct {
+	clientID     string
+	clientSecret string
+	redirectURL  string
+}
+
+// Guild is a server the logged-in user may manage.
+type Guild struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Icon string `json:"icon,omitempty"`
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// handleLogin sends the user to Discord to approve the login.
+func (srv *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	state := randomToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/oauth",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   srv.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	query := url.Values{
+		"client_id":     {srv.oauth.clientID},
+		"redirect_uri":  {srv.oauth.redirectURL},
+		"response_type": {"code"},
+		"scope":         {"identify guilds"},
+		"state":         {state},
+		"prompt":        {"none"},
+	}
+	http.Redirect(w, r, discordOAuth+"?"+query.Encode(), http.StatusFound)
+}
+
+// handleCallback finishes the login: it trades the code for a token, looks up
+// the user and the servers they manage, and starts a session.
+func (srv *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
+	state, err := r.Cookie(stateCookie)
+	if err != nil || state.Value == "" || state.Value != r.URL.Query().Get("state") {
+		http.Error(w, "Login expired, please try again.", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/oauth", MaxAge: -1})
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "Login was cancelled.", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	token, err := srv.oauth.exchange(ctx, code)
+	if err != nil {
+		slog.Warn("Dashboard login failed", "err", err)
+		http.Error(w, "Discord did not accept the login.", http.StatusBadGateway)
+		return
+	}
+
+	var user struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	}
+	if err := discordGet(ctx, token, "/users/@me", &user); err != nil {
+		slog.Warn("Dashboard login failed", "err", err)
+		http.Error(w, "Could not load your Discord account.", http.StatusBadGateway)
+		return
+	}
+	guilds, err := manageableGuilds(ctx, token)
+	if err != nil {
+		slog.Warn("Dashboard login failed", "user", user.ID, "err", err)
+		http.Error(w, "Could not load your Discord servers.", http.StatusBadGateway)
+		return
+	}
+
+	id := srv.sessions.create(&session{UserID: user.ID, Username: user.Username, Guilds: guilds})
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   srv.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	slog.Info("Dashboard login", "user", user.ID, "guilds", len(guilds))
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// handleLogout ends the session. The form must carry the session's CSRF token
+// so other sites can't log users out.
+func (srv *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if sess, ok := srv.sessions.get(cookie.Value); ok && !validCSRF(r, sess) {
+			http.Error(w, "This form has expired, please reload the page.", http.StatusForbidden)
+			return
+		}
+		srv.sessions.delete(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// exchange trades an authorization code for an access token.
+func (o oauthConfig) exchange(ctx context.Context, code string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.redirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", discordAPI+"/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(o.clientID, o.clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request returned status %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("unreadable token response")
+	}
+	return token.AccessToken, nil
+}
+
+// discordGet calls the Discord API on the user's behalf and decodes the response.
+func discordGet(ctx context.Context, token, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", discordAPI+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("%s returned status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// manageableGuilds lists the user's servers where they are the owner or have
+// Manage Server or Administrator.
+func manageableGuilds(ctx context.Context, token string) (map[string]Guild, error) {
+	var guilds []struct {
+		Guild
+		Owner       bool   `json:"owner"`
+		Permissions string `json:"permissions"`
+	}
+	if err := discordGet(ctx, token, "/users/@me/guilds", &guilds); err != nil {
+		return nil, err
+	}
+
+	manageable := map[string]Guild{}
+	for _, g := range guilds {
+		perms, _ := strconv.ParseInt(g.Permissions, 10, 64)
+		if g.Owner || perms&permissionAdministrator != 0 || perms&permissionManageServer != 0 {
+			manageable[g.ID] = g.Guild
+		}
+	}
+	return manageable, nil
+}
+
+// currentSession returns the request's session, if it has a valid one.
+func (srv *Server) currentSession(r *http.Request) (*session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	return srv.sessions.get(cookie.Value)
+}
@@ -0,0 +1,110 @@
+// Package Web serves the admin API and dashboard. Server admins log in with
+// Discord and can manage the servers they have Manage Server on.
+package Web
+
+import (
+	"encoding/json"
+	"fmt"
+	"hellish/Database"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Server holds what the HTTP handlers share.
+type Server struct {
+	db       *Database.DB
+	oauth    oauthConfig
+	sessions *sessionStore
+	// secure marks cookies Secure when the dashboard is served over HTTPS.
+	secure bool
+}
+
+// New reads DISCORD_CLIENT_ID, DISCORD_CLIENT_SECRET and DASHBOARD_URL, the
+// address users reach the dashboard at, e.g. https://bot.example.com.
+func New(db *Database.DB, addr string) (*Server, error) {
+	baseURL := strings.TrimSuffix(os.Getenv("DASHBOARD_URL"), "/")
+	if baseURL == "" {
+		host := addr
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+		baseURL = "http://" + host
+	}
+	oauth := oauthConfig{
+		clientID:     os.Getenv("DISCORD_CLIENT_ID"),
+		clientSecret: os.Getenv("DISCORD_CLIENT_SECRET"),
+		redirectURL:  baseURL + "/oauth/callback",
+	}
+	if oauth.clientID == "" || oauth.clientSecret == "" {
+		return nil, fmt.Errorf("the dashboard needs DISCORD_CLIENT_ID and DISCORD_CLIENT_SECRET")
+	}
+	return &Server{
+		db:       db,
+		oauth:    oauth,
+		sessions: newSessionStore(),
+		secure:   strings.HasPrefix(baseURL, "https://"),
+	}, nil
+}
+
+// Handler routes the login flow, the JSON API under /api and the dashboard.
+func (srv *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /login", srv.handleLogin)
+	mux.HandleFunc("GET /oauth/callback", srv.handleCallback)
+	mux.HandleFunc("POST /logout", srv.handleLogout)
+
+	mux.HandleFunc("GET /api/me", srv.api(srv.apiMe))
+	mux.HandleFunc("GET /api/guilds", srv.api(srv.apiGuilds))
+	mux.HandleFunc("GET /api/guilds/{guild}", srv.guildAPI(srv.apiGuild))
+	mux.HandleFunc("PUT /api/guilds/{guild}/system-message", srv.guildAPI(srv.apiSetSystemMessage))
+	mux.HandleFunc("PUT /api/guilds/{guild}/persona", srv.guildAPI(srv.apiSetPersona))
+	mux.HandleFunc("GET /api/guilds/{guild}/keys", srv.guildAPI(srv.apiKeys))
+	mux.HandleFunc("POST /api/guilds/{guild}/keys", srv.guildAPI(srv.apiAddKey))
+	mux.HandleFunc("DELETE /api/guilds/{guild}/keys/{fingerprint}", srv.guildAPI(srv.apiRemoveKey))
+	mux.HandleFunc("GET /api/guilds/{guild}/usage", srv.guildAPI(srv.apiUsage))
+
+	mux.HandleFunc("GET /{$}", srv.page(srv.pageIndex))
+	mux.HandleFunc("GET /guilds/{guild}", srv.guildPage(srv.pageGuild))
+	mux.HandleFunc("POST /guilds/{guild}/system-message", srv.guildForm(srv.formSystemMessage))
+	mux.HandleFunc("POST /guilds/{guild}/persona", srv.guildForm(srv.formPersona))
+	mux.HandleFunc("POST /guilds/{guild}/keys", srv.guildForm(srv.formAddKey))
+	mux.HandleFunc("POST /guilds/{guild}/keys/{fingerprint}/delete", srv.guildForm(srv.formRemoveKey))
+
+	return securityHeaders(mux)
+}
+
+// securityHeaders keeps the dashboard out of frames and stops browsers from
+// guessing content types.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "same-origin")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON sends value as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Debug("Error writing JSON response", "err", err)
+	}
+}
+
+// writeError sends a JSON error. Internal errors are logged, and the client
+// only gets the message.
+func writeError(w http.ResponseWriter, status int, message string, err error) {
+	if err != nil {
+		slog.Error("Dashboard request failed", "status", status, "err", err)
+	}
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// requestTimeout bounds the database work of one request.
+const requestTimeout = 15 * time.Second
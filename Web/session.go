@@ -0,0 +1,80 @@
+package Web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "hellish_session"
+	// sessionLifetime also bounds how long a user keeps access to a server
+	// after losing Manage Server there, since guilds are checked at login.
+	sessionLifetime = time.Hour
+)
+
+// session is a logged-in dashboard user and the servers they may manage.
+type session struct {
+	UserID   string
+	Username string
+	Guilds   map[string]Guild
+	// CSRF is sent back with dashboard forms to prove they came from us.
+	CSRF    string
+	Expires time.Time
+}
+
+// sessionStore keeps sessions in memory; restarting logs everyone out.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: map[string]*session{}}
+}
+
+// create stores a session and returns its ID.
+func (st *sessionStore) create(sess *session) string {
+	id := randomToken()
+	sess.CSRF = randomToken()
+	sess.Expires = time.Now().Add(sessionLifetime)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	// Drop expired sessions while we're here so the map doesn't grow forever.
+	for key, existing := range st.sessions {
+		if time.Now().After(existing.Expires) {
+			delete(st.sessions, key)
+		}
+	}
+	st.sessions[id] = sess
+	return id
+}
+
+// get returns an unexpired session.
+func (st *sessionStore) get(id string) (*session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sess, ok := st.sessions[id]
+	if !ok || time.Now().After(sess.Expires) {
+		delete(st.sessions, id)
+		return nil, false
+	}
+	return sess, true
+}
+
+func (st *sessionStore) delete(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, id)
+}
+
+// randomToken returns 32 random bytes in hex.
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hellish/Audit"
+	"hellish/Database"
+	"hellish/Discord"
+	"hellish/crypto"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: hellish [command]
+
+Commands:
+  serve                           Run the bot. This is the default.
+  guild show <id>                 Print a server's configuration, with API keys as fingerprints.
+  keys list --guild <id>          List a server's API keys.
+  keys add --guild <id> [key]     Add an API key, read from stdin if not given.
+  keys remove --guild <id> [fp]   Remove an API key by fingerprint, or one read from stdin.
+  export [file]                   Write the whole store as JSON to a file or stdout.
+  import <file>                   Read an export into the store.
+  migrate [--dry-run]             Upgrade stored configs to the current schema.
+  rotate-keys                     Move stored secrets to the active master key.
+  gen-encryption-key [--id n]     Print a new master key for ENCRYPTION_KEY or ENCRYPTION_KEYS.
+  healthcheck [ready]             Ask the running bot's health server whether it is healthy.
+`
+
+// runCommand handles the command-line subcommands that need the database.
+// Export writes the whole store as JSON to a file or stdout; import reads such
+// a file into the store; migrate upgrades stored documents to the current
+// schema; rotate-keys moves stored secrets to the active master key; guild and
+// keys inspect and fix a server's config without going through Discord.
+func runCommand(ctx context.Context, store Database.Store, db *Database.DB, args []string) error {
+	switch args[0] {
+	case "migrate":
+		dryRun := len(args) > 1 && args[1] == "--dry-run"
+		report, err := Database.Migrate(ctx, store, dryRun)
+		if err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+		slog.Info(report.String())
+		return nil
+
+	case "rotate-keys":
+		if err := crypto.Init(); err != nil {
+			return fmt.Errorf("failed to initialize encryption: %w", err)
+		}
+		// Old unbound secrets must stay readable here so they can be migrated.
+		crypto.AllowUnbound(true)
+		slog.Info("Rotating data keys", "master_key", crypto.Describe())
+		report, err := Database.RotateKeys(ctx, store, func(done, total int, serverId string, changed int) {
+			slog.Info("Rotated server", "progress", fmt.Sprintf("%d/%d", done, total), "guild", serverId, "changes", changed)
+		})
+		if err != nil {
+			return fmt.Errorf("rotation stopped: %w", err)
+		}
+		slog.Info(report.String())
+		if len(report.Failed) > 0 {
+			return fmt.Errorf("some secrets could not be decrypted, keep their old master key configured")
+		}
+		if len(report.Misplaced) > 0 {
+			return fmt.Errorf("some secrets don't belong to the server they are stored on")
+		}
+		return nil
+
+	case "export":
+		dump, err := store.Export(ctx)
+		if err != nil {
+			return fmt.Errorf("export failed: %w", err)
+		}
+
+		var out io.Writer = os.Stdout
+		if len(args) > 1 {
+			file, err := os.Create(args[1])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			out = file
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(dump); err != nil {
+			return fmt.Errorf("export failed: %w", err)
+		}
+		slog.Info("Export finished", "servers", len(dump.Servers), "incidents", len(dump.Incidents),
+			"automod_cases", len(dump.AutoModCases), "audit_entries", len(dump.AuditLog))
+		return nil
+
+	case "import":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: hellish import <file>")
+		}
+		file, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		var dump Database.Dump
+		if err := json.NewDecoder(file).Decode(&dump); err != nil {
+			return fmt.Errorf("could not read %s: %w", args[1], err)
+		}
+		if err := Database.Import(ctx, store, dump); err != nil {
+			return fmt.Errorf("import failed: %w", err)
+		}
+		slog.Info("Import finished", "servers", len(dump.Servers), "incidents", len(dump.Incidents),
+			"automod_cases", len(dump.AutoModCases), "audit_entries", len(dump.AuditLog))
+		return nil
+
+	case "guild":
+		if len(args) != 3 || args[1] != "show" {
+			return fmt.Errorf("usage: hellish guild show <id>")
+		}
+		return showGuild(ctx, store, args[2])
+
+	case "keys":
+		// With BOT_TOKEN set, key changes reach the audit channel too.
+		if token := os.Getenv("BOT_TOKEN"); token != "" {
+			if err := Discord.MirrorAudit(db, token); err != nil {
+				return err
+			}
+		}
+		return keysCommand(ctx, db, args[1:])
+
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// showGuild prints a server's stored configuration as JSON, flattened the way
+// the audit log shows it, so API keys appear only as fingerprints.
+func showGuild(ctx context.Context, store Database.Store, guildID string) error {
+	if err := crypto.Init(); err != nil {
+		return fmt.Errorf("failed to initialize encryption: %w", err)
+	}
+	config, err := store.FindServer(ctx, guildID)
+	if errors.Is(err, Database.ErrNotFound) {
+		return fmt.Errorf("no configuration stored for server %s", guildID)
+	}
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(Audit.FromConfig(ctx, config))
+}
+
+// keysCommand lists, adds or removes a server's API keys. Changes are recorded
+// in the server's audit log like changes made in Discord or the dashboard.
+func keysCommand(ctx context.Context, db *Database.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: hellish keys add|list|remove --guild <id>")
+	}
+	flags := flag.NewFlagSet("keys "+args[0], flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	guildID := flags.String("guild", "", "server ID")
+	rest, err := parseArgs(flags, args[1:])
+	if err != nil {
+		return err
+	}
+	if *guildID == "" {
+		return fmt.Errorf("--guild is required")
+	}
+	if err := crypto.Init(); err != nil {
+		return fmt.Errorf("failed to initialize encryption: %w", err)
+	}
+
+	switch args[0] {
+	case "list":
+		keys, err := db.APIKeys(ctx, *guildID)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			slog.Info("No API keys are set for this server", "guild", *guildID)
+		}
+		for i, key := range keys {
+			masked := "****"
+			if len(key) > 8 {
+				masked = key[:4] + "..." + key[len(key)-4:]
+			}
+			fmt.Printf("%d. %s %s\n", i+1, Audit.Fingerprint(key), masked)
+		}
+		return nil
+
+	case "add":
+		if len(rest) > 1 {
+			return fmt.Errorf("usage: hellish keys add --guild <id> [key]")
+		}
+		var key string
+		if len(rest) == 1 {
+			key = strings.TrimSpace(rest[0])
+		} else if key, err = readKey(); err != nil {
+			return err
+		}
+		if key == "" {
+			return fmt.Errorf("no key given")
+		}
+		if err := change(ctx, db, *guildID, "cli.keys.add", func() error {
+			return db.AddAPIKey(ctx, *guildID, key)
+		}); err != nil {
+			return err
+		}
+		slog.Info("API key added", "guild", *guildID, "fingerprint", Audit.Fingerprint(key))
+		return nil
+
+	case "remove":
+		// A full key is only read from stdin, so it never lands in the shell
+		// history; on the command line the key is named by its fingerprint.
+		if len(rest) > 1 || (len(rest) == 1 && !strings.HasPrefix(rest[0], "fp:")) {
+			return fmt.Errorf("usage: hellish keys remove --guild <id> [fingerprint], with the key on stdin if no fingerprint is given")
+		}
+		var fingerprint string
+		if len(rest) == 1 {
+			fingerprint = rest[0]
+		} else {
+			key, err := readKey()
+			if err != nil {
+				return err
+			}
+			if key == "" {
+				return fmt.Errorf("no key given")
+			}
+			fingerprint = Audit.Fingerprint(key)
+		}
+		if err := change(ctx, db, *guildID, "cli.keys.remove", func() error {
+			keys, err := db.APIKeys(ctx, *guildID)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if Audit.Fingerprint(key) == fingerprint {
+					return db.RemoveAPIKey(ctx, *guildID, key)
+				}
+			}
+			return Database.ErrAPIKeyNotFound
+		}); err != nil {
+			return err
+		}
+		slog.Info("API key removed", "guild", *guildID, "fingerprint", fingerprint)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown keys command %q, expected add, list or remove", args[0])
+	}
+}
+
+// readKey reads an API key from the first line of stdin. Reading keys from
+// stdin keeps them out of the shell history.
+func readKey() (string, error) {
+	key, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("could not read the key: %w", err)
+	}
+	return strings.TrimSpace(key), nil
+}
+
+// change applies a change to a server and records it in the audit log, with
+// the operating system user as the actor.
+func change(ctx context.Context, db *Database.DB, guildID, action string, apply func() error) error {
+	before := Audit.Take(ctx, db, guildID)
+	if err := apply(); err != nil {
+		return err
+	}
+	actor := "unknown"
+	if u, err := user.Current(); err == nil {
+		actor = u.Username
+	}
+	if _, err := Audit.Record(ctx, db, guildID, "cli", actor, action, before); err != nil {
+		// The change went through, so only log that it couldn't be audited.
+		slog.Error("Error recording audit entry", "guild", guildID, "action", action, "err", err)
+	}
+	return nil
+}
+
+// parseArgs parses flags that may come before, between or after the
+// positional arguments, and returns the positional ones.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// genEncryptionKey prints a new master key. With --id it prints an id:hex entry
+// for ENCRYPTION_KEYS or a keyring file instead.
+func genEncryptionKey(args []string) error {
+	flags := flag.NewFlagSet("gen-encryption-key", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	id := flags.Int("id", 0, "key ID")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *id < 0 {
+		return fmt.Errorf("--id must be a positive number")
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	if *id > 0 {
+		fmt.Printf("%d:%s\n", *id, key)
+		return nil
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// defaultHealthAddr is where the health server listens unless HEALTH_ADDR says
+// otherwise.
+const defaultHealthAddr = ":8081"
+
+// healthAddr reads HEALTH_ADDR; "off" disables the health server.
+func healthAddr() string {
+	switch addr := os.Getenv("HEALTH_ADDR"); addr {
+	case "":
+		return defaultHealthAddr
+	case "off":
+		return ""
+	default:
+		return addr
+	}
+}
+
+// healthcheck asks the local health server whether the bot is alive, or ready
+// with "ready", and returns the exit code Docker expects: 0 if healthy, 1 if not.
+func healthcheck(args []string) int {
+	addr := healthAddr()
+	if addr == "" {
+		fmt.Fprintln(os.Stderr, "HEALTH_ADDR is off")
+		return 1
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid HEALTH_ADDR:", err)
+		return 1
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	path := "/healthz"
+	if len(args) > 0 && args[0] == "ready" {
+		path = "/readyz"
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
@@ -5,97 +5,193 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"strconv"
+	"strings"
 )
 
-var secretKey []byte
+// Prefixes of values sealed with a guild's data key. Bound values also
+// authenticate the guild and field they belong to; unbound ones predate that.
+const (
+	boundPrefix   = "dk2:"
+	unboundPrefix = "dk:"
+)
+
+var (
+	// ErrMisplaced means a bound value failed to authenticate: it was moved from
+	// another guild or field, or tampered with.
+	ErrMisplaced = errors.New("secret does not belong here: it was copied from another server or field, or modified")
+	// ErrUnbound means an unbound value was rejected because ALLOW_UNBOUND_SECRETS is false.
+	ErrUnbound = errors.New("secret is not bound to its server, run rotate-keys to migrate it")
+)
 
-// Init loads the encryption key from an environment variable.
-// It must be called once at application startup.
-func Init() error {
+// allowUnbound controls whether values from before binding are still accepted.
+var allowUnbound = true
 
-	keyHex := os.Getenv("ENCRYPTION_KEY")
-	if keyHex == "" {
-		return fmt.Errorf("ENCRYPTION_KEY environment variable not set")
+// AllowUnbound overrides ALLOW_UNBOUND_SECRETS, e.g. so rotate-keys can migrate
+// old values after they have been switched off.
+func AllowUnbound(allow bool) {
+	allowUnbound = allow
+}
+
+// Seal encrypts a value with a data key and binds it to a guild and field
+// through the AEAD associated data. It returns "dk2:<hex>".
+func Seal(dataKey []byte, text string, guildID string, field string) (string, error) {
+	sealed, err := seal(dataKey, []byte(text), associatedData(guildID, field))
+	if err != nil {
+		return "", err
 	}
-	// AES-256 requires a 32-byte key, which is 64 hex characters.
-	if len(keyHex) != 64 {
-		return fmt.Errorf("ENCRYPTION_KEY must be a 64-character hex string for a 32-byte key")
+	return boundPrefix + hex.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value stored in a guild's field. Bound values must have been
+// sealed for that same guild and field, or ErrMisplaced is returned. Values from
+// before binding, either sealed with the data key alone or encrypted directly
+// with a master key, are accepted unless ALLOW_UNBOUND_SECRETS is false.
+func Open(dataKey []byte, encrypted string, guildID string, field string) (string, error) {
+	if !IsBound(encrypted) {
+		if !allowUnbound {
+			return "", ErrUnbound
+		}
+		if !strings.HasPrefix(encrypted, unboundPrefix) {
+			return decryptLegacy(encrypted)
+		}
+	}
+	if dataKey == nil {
+		return "", fmt.Errorf("failed to decrypt: no data key")
 	}
 
-	var err error
-	secretKey, err = hex.DecodeString(keyHex)
+	bound := IsBound(encrypted)
+	var aad []byte
+	if bound {
+		aad = associatedData(guildID, field)
+	}
+	encryptedHex := strings.TrimPrefix(strings.TrimPrefix(encrypted, boundPrefix), unboundPrefix)
+	ciphertext, err := hex.DecodeString(encryptedHex)
 	if err != nil {
-		return fmt.Errorf("failed to decode ENCRYPTION_KEY from hex: %w", err)
+		return "", err
+	}
+	plaintext, err := open(dataKey, ciphertext, aad)
+	if err != nil && bound {
+		return "", ErrMisplaced
 	}
-	return nil
+	return string(plaintext), err
 }
 
-// Encrypt takes a plaintext string and returns a hex-encoded encrypted string.
-func Encrypt(text string) (string, error) {
-	if secretKey == nil {
-		return "", fmt.Errorf("crypto package not initialized")
-	}
+// IsBound reports whether a value is sealed with a data key and bound to its
+// guild and field.
+func IsBound(encrypted string) bool {
+	return strings.HasPrefix(encrypted, boundPrefix)
+}
 
-	plaintext := []byte(text)
+// associatedData is authenticated alongside a sealed value but not stored.
+// Lengths are included so that no two (guild, field) pairs encode the same.
+func associatedData(guildID string, field string) []byte {
+	return fmt.Appendf(nil, "hellish/v1;guild=%d:%s;field=%d:%s", len(guildID), guildID, len(field), field)
+}
 
-	block, err := aes.NewCipher(secretKey)
+// decryptLegacy handles "v<key id>:<hex>" ciphertexts and, before that,
+// unversioned ones, on which every local key is tried.
+func decryptLegacy(encrypted string) (string, error) {
+	var rings []*keyring
+	for _, name := range []string{"env", "file"} {
+		if ring, ok := providers[name].(*keyring); ok {
+			rings = append(rings, ring)
+		}
+	}
+	if len(rings) == 0 {
+		return "", fmt.Errorf("failed to decrypt: legacy ciphertexts need ENCRYPTION_KEY or ENCRYPTION_KEYFILE")
+	}
+
+	id := 0
+	encryptedHex := encrypted
+	if strings.Contains(encrypted, ":") {
+		var err error
+		if id, encryptedHex, err = parseVersioned(encrypted); err != nil {
+			return "", err
+		}
+	}
+	ciphertext, err := hex.DecodeString(encryptedHex)
 	if err != nil {
 		return "", err
 	}
 
+	// GCM authenticates the data, so a wrong key fails instead of returning garbage.
+	for _, ring := range rings {
+		for _, keyID := range ring.ids() {
+			if id != 0 && keyID != id {
+				continue
+			}
+			if plaintext, err := open(ring.keys[keyID], ciphertext, nil); err == nil {
+				return string(plaintext), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("failed to decrypt: no loaded key matches")
+}
+
+// parseVersioned splits "v<id>:<rest>".
+func parseVersioned(text string) (int, string, error) {
+	version, rest, ok := strings.Cut(text, ":")
+	if !ok || !strings.HasPrefix(version, "v") {
+		return 0, "", fmt.Errorf("malformed ciphertext version %q", version)
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(version, "v"))
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed ciphertext version %q", version)
+	}
+	return id, rest, nil
+}
+
+// seal encrypts with AES-256-GCM and prepends the nonce. The additional data is
+// authenticated but not encrypted or included.
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
 	// GCM is an authenticated encryption mode that provides confidentiality and authenticity.
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// A nonce is a number used once. It's required for GCM and must be unique for each encryption.
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Seal encrypts the data. We prepend the nonce to the ciphertext for use during decryption.
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return hex.EncodeToString(ciphertext), nil
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
 }
 
-// Decrypt takes a hex-encoded encrypted string and returns the original plaintext string.
-func Decrypt(encryptedHex string) (string, error) {
-	if secretKey == nil {
-		return "", fmt.Errorf("crypto package not initialized")
-	}
-
-	ciphertext, err := hex.DecodeString(encryptedHex)
+func open(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
-	}
-
-	block, err := aes.NewCipher(secretKey)
-	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	nonceSize := gcm.NonceSize()
 	if len(ciphertext) < nonceSize {
-		return "", fmt.Errorf("ciphertext is too short")
+		return nil, fmt.Errorf("ciphertext is too short")
 	}
 
 	// The nonce was prepended to the ciphertext, so we split it off.
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		// This error typically means the key is wrong or the data has been tampered with.
-		return "", fmt.Errorf("failed to decrypt: %w", err)
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
 	}
 
-	return string(plaintext), nil
+	return plaintext, nil
 }
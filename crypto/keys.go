@@ -0,0 +1,200 @@
+package crypto
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keyring is a set of local master keys identified by number. The active key
+// wraps new data keys; the others are only used to unwrap.
+type keyring struct {
+	name   string
+	keys   map[int][]byte
+	active int
+}
+
+func newKeyring(name string) *keyring {
+	return &keyring{name: name, keys: map[int][]byte{}}
+}
+
+func (k *keyring) Name() string { return k.name }
+
+func (k *keyring) Describe() string {
+	return fmt.Sprintf("%s key %d (loaded keys: %v)", k.name, k.active, k.ids())
+}
+
+// Wrap encrypts a data key with the active master key as "<name>:v<id>:<hex>".
+func (k *keyring) Wrap(_ context.Context, dataKey []byte) (string, error) {
+	sealed, err := seal(k.keys[k.active], dataKey, nil)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:v%d:%s", k.name, k.active, hex.EncodeToString(sealed)), nil
+}
+
+func (k *keyring) Unwrap(_ context.Context, wrapped string) ([]byte, error) {
+	_, rest, _ := strings.Cut(wrapped, ":")
+	id, sealedHex, err := parseVersioned(rest)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%s key %d is not loaded", k.name, id)
+	}
+	sealed, err := hex.DecodeString(sealedHex)
+	if err != nil {
+		return nil, err
+	}
+	return open(key, sealed, nil)
+}
+
+func (k *keyring) Current(_ context.Context, wrapped string) (bool, error) {
+	_, rest, _ := strings.Cut(wrapped, ":")
+	id, _, err := parseVersioned(rest)
+	return err == nil && id == k.active, nil
+}
+
+// add registers a key, rejecting a second, different key under the same ID.
+func (k *keyring) add(source string, id int, keyHex string) error {
+	key, err := parseKey(keyHex)
+	if err != nil {
+		return fmt.Errorf("%s: key %d: %w", source, id, err)
+	}
+	if existing, ok := k.keys[id]; ok && string(existing) != string(key) {
+		return fmt.Errorf("%s: key %d is defined twice with different values", source, id)
+	}
+	k.keys[id] = key
+	return nil
+}
+
+// finish picks the active key: ENCRYPTION_KEY_ID if set, else the highest ID.
+func (k *keyring) finish(activeID string) error {
+	for id := range k.keys {
+		k.active = max(k.active, id)
+	}
+	if activeID == "" {
+		return nil
+	}
+	id, err := strconv.Atoi(activeID)
+	if err != nil {
+		return fmt.Errorf("ENCRYPTION_KEY_ID must be a number: %w", err)
+	}
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("ENCRYPTION_KEY_ID %d is not one of the %s keys", id, k.name)
+	}
+	k.active = id
+	return nil
+}
+
+// ids returns the IDs of all loaded keys in ascending order.
+func (k *keyring) ids() []int {
+	ids := make([]int, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// loadEnvKeyring reads ENCRYPTION_KEY (registered as key 1) and
+// ENCRYPTION_KEYS, a comma-separated list of id:hex entries.
+// It returns nil if neither is set.
+func loadEnvKeyring(activeID string) (*keyring, error) {
+	ring := newKeyring("env")
+	if keyHex := os.Getenv("ENCRYPTION_KEY"); keyHex != "" {
+		if err := ring.add("ENCRYPTION_KEY", 1, keyHex); err != nil {
+			return nil, err
+		}
+	}
+	if list := os.Getenv("ENCRYPTION_KEYS"); list != "" {
+		for _, entry := range strings.Split(list, ",") {
+			id, keyHex, err := parseEntry(entry)
+			if err == nil {
+				err = ring.add("ENCRYPTION_KEYS", id, keyHex)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("ENCRYPTION_KEYS: %w", err)
+			}
+		}
+	}
+	if len(ring.keys) == 0 {
+		return nil, nil
+	}
+	return ring, ring.finish(activeID)
+}
+
+// loadFileKeyring reads a keyring file with one id:hex entry per line.
+// Blank lines and lines starting with # are ignored.
+func loadFileKeyring(path string, activeID string) (*keyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ENCRYPTION_KEYFILE: %w", err)
+	}
+	defer file.Close()
+
+	ring := newKeyring("file")
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, keyHex, err := parseEntry(text)
+		if err == nil {
+			err = ring.add(path, id, keyHex)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ring.keys) == 0 {
+		return nil, fmt.Errorf("%s contains no keys", path)
+	}
+	return ring, ring.finish(activeID)
+}
+
+// parseEntry splits an "id:hex" key entry.
+func parseEntry(entry string) (int, string, error) {
+	idText, keyHex, ok := strings.Cut(strings.TrimSpace(entry), ":")
+	if !ok {
+		return 0, "", fmt.Errorf("expected id:hex, got %q", entry)
+	}
+	id, err := strconv.Atoi(idText)
+	if err != nil || id < 1 {
+		return 0, "", fmt.Errorf("key ID must be a positive number, got %q", idText)
+	}
+	return id, keyHex, nil
+}
+
+// GenerateKey returns a new random master key as the 64-character hex string
+// that ENCRYPTION_KEY, ENCRYPTION_KEYS and keyring files expect.
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func parseKey(keyHex string) ([]byte, error) {
+	// AES-256 requires a 32-byte key, which is 64 hex characters.
+	if len(keyHex) != 64 {
+		return nil, fmt.Errorf("must be a 64-character hex string for a 32-byte key")
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode from hex: %w", err)
+	}
+	return key, nil
+}
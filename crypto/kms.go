@@ -0,0 +1,195 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Provider protects data keys with a master key it holds. Wrapped keys start
+// with the provider's name so any configured provider can be found to unwrap
+// them.
+type Provider interface {
+	Name() string
+	// Describe says which master key is in use, for logs.
+	Describe() string
+	Wrap(ctx context.Context, dataKey []byte) (string, error)
+	Unwrap(ctx context.Context, wrapped string) ([]byte, error)
+	// Current reports whether a wrapped key uses the provider's active master key.
+	Current(ctx context.Context, wrapped string) (bool, error)
+}
+
+var (
+	// active wraps new data keys; providers holds every configured provider by name.
+	active    Provider
+	providers map[string]Provider
+
+	// unwrapped caches data keys by their wrapped form, so Vault isn't asked
+	// on every message.
+	unwrappedMu sync.Mutex
+	unwrapped   = map[string][]byte{}
+
+	initialized atomic.Bool
+)
+
+// Init loads the master key providers. It must be called once at application
+// startup. KMS picks the provider for new data keys: "env" (ENCRYPTION_KEY,
+// ENCRYPTION_KEYS), "file" (ENCRYPTION_KEYFILE) or "vault" (VAULT_ADDR). It
+// defaults to vault, then file, then env, depending on what is configured.
+// The other configured providers are only used to unwrap. Setting
+// ALLOW_UNBOUND_SECRETS to false rejects secrets from before binding.
+func Init() error {
+	activeID := os.Getenv("ENCRYPTION_KEY_ID")
+	loaded := map[string]Provider{}
+
+	env, err := loadEnvKeyring(activeID)
+	if err != nil {
+		return err
+	}
+	if env != nil {
+		loaded["env"] = env
+	}
+	if path := os.Getenv("ENCRYPTION_KEYFILE"); path != "" {
+		file, err := loadFileKeyring(path, activeID)
+		if err != nil {
+			return err
+		}
+		loaded["file"] = file
+	}
+	vault, err := loadVault()
+	if err != nil {
+		return err
+	}
+	if vault != nil {
+		loaded["vault"] = vault
+	}
+
+	name := os.Getenv("KMS")
+	if name == "" {
+		for _, candidate := range []string{"vault", "file", "env"} {
+			if _, ok := loaded[candidate]; ok {
+				name = candidate
+				break
+			}
+		}
+	}
+	if name == "" {
+		return fmt.Errorf("no master key configured, set ENCRYPTION_KEY, ENCRYPTION_KEYFILE or VAULT_ADDR")
+	}
+	provider, ok := loaded[name]
+	if !ok {
+		return fmt.Errorf("KMS is %q but that provider is not configured", name)
+	}
+
+	active, providers = provider, loaded
+	allowUnbound = os.Getenv("ALLOW_UNBOUND_SECRETS") != "false"
+	initialized.Store(true)
+	return nil
+}
+
+// Initialized reports whether Init has succeeded. It is safe to call from any
+// goroutine, e.g. a health check.
+func Initialized() bool {
+	return initialized.Load()
+}
+
+// Describe says which master key wraps new data keys.
+func Describe() string {
+	if active == nil {
+		return "not initialized"
+	}
+	return active.Describe()
+}
+
+// NewDataKey generates a data key and returns it along with its wrapped form,
+// which is what gets stored.
+func NewDataKey(ctx context.Context) ([]byte, string, error) {
+	if active == nil {
+		return nil, "", fmt.Errorf("crypto package not initialized")
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", err
+	}
+	wrapped, err := active.Wrap(ctx, dataKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	remember(wrapped, dataKey)
+	return dataKey, wrapped, nil
+}
+
+// UnwrapDataKey recovers a data key with whichever provider wrapped it.
+func UnwrapDataKey(ctx context.Context, wrapped string) ([]byte, error) {
+	unwrappedMu.Lock()
+	dataKey, ok := unwrapped[wrapped]
+	unwrappedMu.Unlock()
+	if ok {
+		return dataKey, nil
+	}
+
+	provider, err := providerFor(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err = provider.Unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	remember(wrapped, dataKey)
+	return dataKey, nil
+}
+
+// NeedsRewrap reports whether a data key is wrapped by anything other than the
+// active provider's active master key.
+func NeedsRewrap(ctx context.Context, wrapped string) (bool, error) {
+	if active == nil {
+		return false, nil
+	}
+	name, _, _ := strings.Cut(wrapped, ":")
+	if name != active.Name() {
+		return true, nil
+	}
+	current, err := active.Current(ctx, wrapped)
+	if err != nil {
+		return false, fmt.Errorf("failed to check the master key version: %w", err)
+	}
+	return !current, nil
+}
+
+// RewrapDataKey wraps an existing data key with the active master key. The
+// data key itself is unchanged, so values sealed with it stay readable.
+func RewrapDataKey(ctx context.Context, wrapped string) (string, error) {
+	dataKey, err := UnwrapDataKey(ctx, wrapped)
+	if err != nil {
+		return "", err
+	}
+	rewrapped, err := active.Wrap(ctx, dataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	remember(rewrapped, dataKey)
+	return rewrapped, nil
+}
+
+func providerFor(wrapped string) (Provider, error) {
+	if providers == nil {
+		return nil, fmt.Errorf("crypto package not initialized")
+	}
+	name, _, _ := strings.Cut(wrapped, ":")
+	provider, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("data key is wrapped by %q, which is not configured", name)
+	}
+	return provider, nil
+}
+
+func remember(wrapped string, dataKey []byte) {
+	unwrappedMu.Lock()
+	unwrapped[wrapped] = dataKey
+	unwrappedMu.Unlock()
+}
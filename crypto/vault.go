@@ -0,0 +1,188 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultProvider wraps data keys with a HashiCorp Vault Transit key, so the
+// master key never leaves Vault. Any server implementing the Transit
+// encrypt/decrypt endpoints works.
+type vaultProvider struct {
+	addr   string
+	mount  string
+	key    string
+	token  string
+	client *http.Client
+
+	latestMu sync.Mutex
+	latest   int
+	latestAt time.Time
+}
+
+// loadVault configures the provider from VAULT_ADDR, VAULT_TOKEN or
+// VAULT_TOKEN_FILE, VAULT_TRANSIT_MOUNT and VAULT_TRANSIT_KEY.
+// It returns nil if VAULT_ADDR is not set.
+func loadVault() (*vaultProvider, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, nil
+	}
+
+	token := os.Getenv("VAULT_TOKEN")
+	if path := os.Getenv("VAULT_TOKEN_FILE"); path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read VAULT_TOKEN_FILE: %w", err)
+		}
+		token = strings.TrimSpace(string(raw))
+	}
+	if token == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is set but neither VAULT_TOKEN nor VAULT_TOKEN_FILE is")
+	}
+
+	v := &vaultProvider{
+		addr:   addr,
+		mount:  os.Getenv("VAULT_TRANSIT_MOUNT"),
+		key:    os.Getenv("VAULT_TRANSIT_KEY"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if v.mount == "" {
+		v.mount = "transit"
+	}
+	if v.key == "" {
+		v.key = "hellish"
+	}
+	return v, nil
+}
+
+func (v *vaultProvider) Name() string { return "vault" }
+
+func (v *vaultProvider) Describe() string {
+	return fmt.Sprintf("vault transit key %q at %s/%s", v.key, v.addr, v.mount)
+}
+
+// Wrap returns Vault's own ciphertext ("vault:v<n>:..."), which already
+// carries the provider name and key version.
+func (v *vaultProvider) Wrap(ctx context.Context, dataKey []byte) (string, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	body := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}
+	if err := v.call(ctx, "encrypt", body, &out); err != nil {
+		return "", err
+	}
+	return out.Ciphertext, nil
+}
+
+func (v *vaultProvider) Unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := v.call(ctx, "decrypt", map[string]string{"ciphertext": wrapped}, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+// Current compares the key version in a ciphertext with the Transit key's
+// latest version. Older versions still decrypt until Vault's
+// min_decryption_version passes them, but rotate-keys should move off them.
+func (v *vaultProvider) Current(ctx context.Context, wrapped string) (bool, error) {
+	version, err := vaultVersion(wrapped)
+	if err != nil {
+		return false, err
+	}
+	latest, err := v.latestVersion(ctx)
+	if err != nil {
+		return false, err
+	}
+	return version >= latest, nil
+}
+
+// latestVersion finds the Transit key's latest version by encrypting a probe,
+// since every ciphertext names the version that made it. Unlike reading the
+// key's configuration, this needs no permission beyond encrypt. The answer is
+// cached for versionTTL.
+func (v *vaultProvider) latestVersion(ctx context.Context) (int, error) {
+	v.latestMu.Lock()
+	defer v.latestMu.Unlock()
+	if v.latest > 0 && time.Since(v.latestAt) < versionTTL {
+		return v.latest, nil
+	}
+	probe, err := v.Wrap(ctx, []byte("version probe"))
+	if err != nil {
+		return 0, err
+	}
+	version, err := vaultVersion(probe)
+	if err != nil {
+		return 0, err
+	}
+	v.latest, v.latestAt = version, time.Now()
+	return version, nil
+}
+
+// versionTTL is how long a Transit key's latest version is trusted.
+const versionTTL = time.Minute
+
+// vaultVersion reads the key version from a "vault:v<n>:..." ciphertext.
+func vaultVersion(ciphertext string) (int, error) {
+	rest, ok := strings.CutPrefix(ciphertext, "vault:v")
+	if ok {
+		if text, _, found := strings.Cut(rest, ":"); found {
+			if version, err := strconv.Atoi(text); err == nil && version > 0 {
+				return version, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("not a vault ciphertext")
+}
+
+// call posts to /v1/<mount>/<operation>/<key> and decodes the "data" field of
+// the response into out. The request is abandoned when ctx is done.
+func (v *vaultProvider) call(ctx context.Context, operation string, body any, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", v.addr, v.mount, operation, v.key)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s request failed: %w", operation, err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read vault response: %w", err)
+	}
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("failed to decode vault response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault %s failed with status %d: %s", operation, resp.StatusCode, strings.Join(result.Errors, "; "))
+	}
+	return json.Unmarshal(result.Data, out)
+}
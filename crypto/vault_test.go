@@ -0,0 +1,235 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testToken = "test-token"
+
+// transitStandIn imitates the encrypt and decrypt endpoints of a Vault Transit
+// key. Its "ciphertexts" are the plaintext reversed and base64-encoded,
+// behind the key version.
+type transitStandIn struct {
+	mu      sync.Mutex
+	version int
+	calls   int
+}
+
+func (t *transitStandIn) rotate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.version++
+}
+
+func (t *transitStandIn) callCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.calls
+}
+
+func (t *transitStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls++
+
+	if r.Header.Get("X-Vault-Token") != testToken {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]any{"errors": []string{"permission denied"}})
+		return
+	}
+	var body map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var data map[string]string
+	switch r.URL.Path {
+	case "/v1/transit/encrypt/hellish":
+		plaintext, _ := base64.StdEncoding.DecodeString(body["plaintext"])
+		sealed := base64.StdEncoding.EncodeToString(reverse(plaintext))
+		data = map[string]string{"ciphertext": fmt.Sprintf("vault:v%d:%s", t.version, sealed)}
+	case "/v1/transit/decrypt/hellish":
+		version, err := vaultVersion(body["ciphertext"])
+		var sealed []byte
+		if err == nil {
+			parts := strings.SplitN(body["ciphertext"], ":", 3)
+			sealed, err = base64.StdEncoding.DecodeString(parts[2])
+		}
+		if err != nil || version > t.version {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{"errors": []string{"invalid ciphertext"}})
+			return
+		}
+		data = map[string]string{"plaintext": base64.StdEncoding.EncodeToString(reverse(sealed))}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
+
+// startVault serves a stand-in at version 1 and points VAULT_ADDR at it.
+func startVault(t *testing.T, token string) *transitStandIn {
+	t.Helper()
+	transit := &transitStandIn{version: 1}
+	server := httptest.NewServer(transit)
+	t.Cleanup(server.Close)
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", token)
+	return transit
+}
+
+func TestVaultWrapUnwrap(t *testing.T) {
+	ctx := context.Background()
+	startVault(t, testToken)
+	v, err := loadVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := v.Wrap(ctx, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(wrapped, "vault:v1:") {
+		t.Errorf("wrapped key %q doesn't carry the provider and version", wrapped)
+	}
+	unwrapped, err := v.Unwrap(ctx, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("unwrapped %q, want %q", unwrapped, dataKey)
+	}
+}
+
+func TestVaultAuthFailure(t *testing.T) {
+	ctx := context.Background()
+	startVault(t, "wrong-token")
+	v, err := loadVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = v.Wrap(ctx, []byte("key"))
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Wrap with a bad token returned %v, want a 403 permission denied error", err)
+	}
+	if _, err := v.Unwrap(ctx, "vault:v1:eWVr"); err == nil {
+		t.Error("Unwrap with a bad token succeeded")
+	}
+}
+
+func TestVaultVersions(t *testing.T) {
+	ctx := context.Background()
+	transit := startVault(t, testToken)
+	v, err := loadVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := v.Wrap(ctx, []byte("data key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, err := v.Current(ctx, old); err != nil || !current {
+		t.Fatalf("Current(%q) = %v, %v before rotation, want true", old, current, err)
+	}
+
+	transit.rotate()
+	v.latestAt = v.latestAt.Add(-versionTTL) // skip the cache
+	if current, err := v.Current(ctx, old); err != nil || current {
+		t.Errorf("Current(%q) = %v, %v after rotation, want false", old, current, err)
+	}
+	fresh, err := v.Wrap(ctx, []byte("data key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, err := v.Current(ctx, fresh); err != nil || !current {
+		t.Errorf("Current(%q) = %v, %v, want true", fresh, current, err)
+	}
+	// Older versions still decrypt.
+	if plaintext, err := v.Unwrap(ctx, old); err != nil || string(plaintext) != "data key" {
+		t.Errorf("Unwrap(%q) = %q, %v after rotation", old, plaintext, err)
+	}
+
+	calls := transit.callCount()
+	for range 3 {
+		v.Current(ctx, fresh)
+	}
+	if n := transit.callCount() - calls; n != 0 {
+		t.Errorf("Current asked Vault %d more times, want the cached version used", n)
+	}
+
+	if _, err := v.Current(ctx, "env:v1:abcd"); err == nil {
+		t.Error("Current accepted a key that isn't a vault ciphertext")
+	}
+}
+
+func TestVaultRewrap(t *testing.T) {
+	ctx := context.Background()
+	transit := startVault(t, testToken)
+	t.Setenv("KMS", "vault")
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	dataKey, wrapped, err := NewDataKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if needs, err := NeedsRewrap(ctx, wrapped); err != nil || needs {
+		t.Fatalf("NeedsRewrap(ctx, %q) = %v, %v, want false", wrapped, needs, err)
+	}
+
+	transit.rotate()
+	active.(*vaultProvider).latestAt = active.(*vaultProvider).latestAt.Add(-versionTTL)
+	if needs, err := NeedsRewrap(ctx, wrapped); err != nil || !needs {
+		t.Fatalf("NeedsRewrap(ctx, %q) = %v, %v after rotation, want true", wrapped, needs, err)
+	}
+	rewrapped, err := RewrapDataKey(ctx, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rewrapped, "vault:v2:") {
+		t.Errorf("rewrapped key %q, want version 2", rewrapped)
+	}
+	unwrapped, err := UnwrapDataKey(ctx, rewrapped)
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("UnwrapDataKey(ctx, %q) = %x, %v, want the original data key", rewrapped, unwrapped, err)
+	}
+}
+
+func TestVaultCancelled(t *testing.T) {
+	startVault(t, testToken)
+	v, err := loadVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := v.Wrap(ctx, []byte("key")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wrap with a cancelled context returned %v, want context.Canceled", err)
+	}
+}
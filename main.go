@@ -1,27 +1,210 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"hellish/AI"
 	"hellish/Database"
 	"hellish/Discord"
+	"hellish/Health"
+	"hellish/Logging"
+	"hellish/Metrics"
+	"hellish/Tracing"
+	"hellish/Web"
 	"hellish/crypto"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv" // Add this import
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run starts the bot or runs a command and returns the exit code. Deferred
+// cleanup runs before main exits.
+func run() int {
+
+	envErr := godotenv.Load()
+	// LOG_LEVEL and LOG_FORMAT may come from .env, so set up logging after loading it.
+	Logging.Init()
+	if envErr != nil {
+		slog.Info(".env file not found, relying on variables from environment")
+	}
 
-	if err := godotenv.Load(); err != nil {
-		log.Println("Info: .env file not found, relying on variables from environment.")
+	// With no command, or `serve`, the bot runs; see usage for the others.
+	var args []string
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		args = os.Args[1:]
 	}
 
-	if err := Database.ConnectDB(); err != nil {
-		log.Fatalf("Fatal error: Failed to connect to the database: %v", err)
+	// These commands don't need the database. `hellish healthcheck [ready]`
+	// asks the running bot's health server, for Docker's HEALTHCHECK.
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "--help":
+			fmt.Print(usage)
+			return 0
+		case "healthcheck":
+			return healthcheck(args[1:])
+		case "gen-encryption-key":
+			if err := genEncryptionKey(args[1:]); err != nil {
+				slog.Error("Command failed", "command", args[0], "err", err)
+				return 1
+			}
+			return 0
+		}
 	}
+
+	// Traces are exported over OTLP only when an OTEL_EXPORTER_OTLP_* endpoint is set.
+	shutdownTracing, err := Tracing.Init(context.Background())
+	if err != nil {
+		slog.Error("Failed to set up tracing", "err", err)
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("Error flushing traces", "err", err)
+		}
+	}()
+
+	// STORE selects the backend (e.g. bolt://hellish.db); without it we use MONGO_URL.
+	store, err := Database.Open(os.Getenv("STORE"), os.Getenv("MONGO_URL"))
+	if err != nil {
+		slog.Error("Failed to connect to the database", "err", err)
+		return 1
+	}
+	// Guild configs are cached in memory; CACHE_TTL bounds how stale a replica can get
+	// when the store can't push changes (e.g. MongoDB without a replica set).
+	cacheTTL := time.Minute
+	if ttl := os.Getenv("CACHE_TTL"); ttl != "" {
+		if cacheTTL, err = time.ParseDuration(ttl); err != nil {
+			slog.Error("Invalid CACHE_TTL", "err", err)
+			return 1
+		}
+	}
+	cached := Database.NewCachedStore(store, cacheTTL)
+	expvar.Publish("guild_cache", expvar.Func(func() any { return cached.Stats() }))
+	Metrics.NewCounterFunc("hellish_guild_cache_hits_total", "Guild config lookups answered from the cache.",
+		func() float64 { return float64(cached.Stats().Hits) })
+	Metrics.NewCounterFunc("hellish_guild_cache_misses_total", "Guild config lookups that went to the store.",
+		func() float64 { return float64(cached.Stats().Misses) })
+	Metrics.NewCounterFunc("hellish_guild_cache_invalidations_total", "Guild configs dropped from the cache because they changed.",
+		func() float64 { return float64(cached.Stats().Invalidations) })
+	Metrics.NewGaugeFunc("hellish_guild_cache_entries", "Guild configs in the cache.",
+		func() float64 { return float64(cached.Stats().Entries) })
+
+	// DEBUG_ADDR serves runtime and cache stats at /debug/vars and Prometheus
+	// metrics at /metrics.
+	if addr := os.Getenv("DEBUG_ADDR"); addr != "" {
+		http.Handle("/metrics", Metrics.Handler())
+		debugServer := &http.Server{Addr: addr}
+		go func() {
+			slog.Info("Debug server listening", "addr", addr)
+			if err := debugServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Debug server stopped", "err", err)
+			}
+		}()
+		defer debugServer.Close()
+	}
+
+	// SIGINT or SIGTERM (e.g. docker stop) cancels commands and startup work, and
+	// lets running replies finish before the Discord session and the database close.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db := Database.New(cached)
+	defer func() {
+		if err := db.Close(); err != nil {
+			slog.Error("Error closing the database", "err", err)
+		}
+	}()
+
+	// `hellish export [file]` and `hellish import <file>` move data between backends;
+	// `hellish migrate [--dry-run]` upgrades it in place and `hellish rotate-keys`
+	// moves stored secrets to the active master key. `hellish guild` and
+	// `hellish keys` fix a server's config without going through Discord.
+	if len(args) > 0 {
+		if err := runCommand(ctx, store, db, args); err != nil {
+			slog.Error("Command failed", "command", args[0], "err", err)
+			return 1
+		}
+		return 0
+	}
+
+	// HEALTH_ADDR serves /healthz and /readyz; it starts before migrations so a
+	// long migration doesn't look like a hung process.
+	if addr := healthAddr(); addr != "" {
+		Health.Ready("database", db.Ping)
+		Health.Ready("crypto", func(context.Context) error {
+			if !crypto.Initialized() {
+				return errors.New("encryption not initialized")
+			}
+			return nil
+		})
+		healthServer := &http.Server{Addr: addr, Handler: Health.Handler(), ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			slog.Info("Health server listening", "addr", addr)
+			if err := healthServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Health server stopped", "err", err)
+			}
+		}()
+		defer healthServer.Close()
+	}
+
+	if os.Getenv("MIGRATE_ON_START") != "false" {
+		report, err := Database.Migrate(ctx, store, false)
+		if err != nil {
+			slog.Error("Failed to migrate the database", "err", err)
+			return 1
+		}
+		slog.Info(report.String())
+	}
+
 	if err := crypto.Init(); err != nil {
-		log.Fatalf("Fatal error: Failed to initialize encryption: %v", err)
+		slog.Error("Failed to initialize encryption", "err", err)
+		return 1
+	}
+
+	// Changes from Discord, the dashboard and the API all reach the audit channel.
+	if err := Discord.MirrorAudit(db, os.Getenv("BOT_TOKEN")); err != nil {
+		slog.Error("Failed to set up audit mirroring", "err", err)
+		return 1
 	}
-	defer Database.DisconnectDB()
 
-	Discord.Dc()
+	// DASHBOARD_ADDR serves the admin API and dashboard, e.g. ":8080".
+	if addr := os.Getenv("DASHBOARD_ADDR"); addr != "" {
+		dashboard, err := Web.New(db, addr)
+		if err != nil {
+			slog.Error("Failed to set up the dashboard", "err", err)
+			return 1
+		}
+		dashboardServer := &http.Server{Addr: addr, Handler: dashboard.Handler(), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			slog.Info("Dashboard listening", "addr", addr)
+			if err := dashboardServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Dashboard stopped", "err", err)
+			}
+		}()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			dashboardServer.Shutdown(shutdownCtx)
+		}()
+	}
+
+	if err := Discord.Dc(ctx, db, AI.New(db)); err != nil {
+		slog.Error("Bot stopped", "err", err)
+		return 1
+	}
+	return 0
 }